@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// vertexError is an error with a vertex in the graph. It records the
+// chain of vertices from the head that leads to the vertex so the error
+// can be traced back to the nix code that produced it.
+type vertexError struct {
+	chain []link
+	err   error
+}
+
+func (e *vertexError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.err.Error())
+	for i := len(e.chain) - 1; i >= 0; i-- {
+		if l := e.chain[i]; l.input < 0 {
+			fmt.Fprintf(&b, "\n\tat %s", l)
+		} else {
+			fmt.Fprintf(&b, "\n\tinput %d of %s", l.input, l)
+		}
+	}
+	return b.String()
+}
+
+func (e *vertexError) Unwrap() error {
+	return e.err
+}
+
+// link is a vertex in the chain along with the index of the input
+// that leads to the next vertex. The input is -1 for the last vertex.
+type link struct {
+	path  string
+	name  string
+	input int
+}
+
+func newLink(path string, v *Vertex, input int) link {
+	l := link{path: path, input: input}
+	if v != nil && v.Meta != nil {
+		l.name = v.Meta.Description["llb.customname"]
+	}
+	return l
+}
+
+func (l link) String() string {
+	var details []string
+	if name := derivationName(l.path); name != "" {
+		details = append(details, "derivation "+name)
+	}
+	if l.name != "" {
+		details = append(details, strconv.Quote(l.name))
+	}
+
+	if len(details) == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s (%s)", l.path, strings.Join(details, ", "))
+}
+
+var storePathRe = regexp.MustCompile(`^[0-9a-df-np-sv-z]{32}-(.+)$`)
+
+// derivationName returns the name of the derivation that produced the
+// store path containing the file.
+func derivationName(fpath string) string {
+	for _, elem := range strings.Split(fpath, "/") {
+		if m := storePathRe.FindStringSubmatch(elem); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// errorAt returns an error for the vertex at path with the chain of
+// vertices that lead to it from the result.
+func errorAt(specs map[string]*Vertex, path string, input int, err error) error {
+	seen := make(map[string]struct{})
+
+	var find func(p string) ([]link, bool)
+	find = func(p string) ([]link, bool) {
+		v := specs[p]
+		if p == path {
+			return []link{newLink(p, v, input)}, true
+		} else if _, ok := seen[p]; ok || v == nil {
+			return nil, false
+		}
+		seen[p] = struct{}{}
+
+		for i, inp := range v.Op.Inputs {
+			if chain, ok := find(inp.Digest); ok {
+				if isResult(p) {
+					// The result is not part of the original graph.
+					return chain, true
+				}
+				return append([]link{newLink(p, v, i)}, chain...), true
+			}
+		}
+		return nil, false
+	}
+
+	var results []string
+	for p := range specs {
+		if isResult(p) {
+			results = append(results, p)
+		}
+	}
+	slices.Sort(results)
+
+	var chain []link
+	for _, p := range results {
+		if c, ok := find(p); ok {
+			chain = c
+			break
+		}
+	}
+	if len(chain) == 0 {
+		chain = []link{newLink(path, specs[path], input)}
+	}
+	return &vertexError{chain: chain, err: err}
+}
@@ -6,66 +6,120 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/jsternberg/nix-frontend/dockerfile"
 	"github.com/moby/buildkit/solver/pb"
 	"github.com/opencontainers/go-digest"
 	"github.com/urfave/cli/v2"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 type Vertex = dockerfile.Vertex
 
-func load(input string) (map[string]*Vertex, []string, error) {
-	unvisited := make(map[string]struct{})
-	unvisited[input] = struct{}{}
-	order := []string{input}
+// head is a named output of the definition.
+type head struct {
+	name  string
+	path  string
+	check string
+}
+
+// resultPrefix is the prefix of the synthetic result vertex that is
+// created for each head. Vertices are otherwise keyed by their path
+// so the prefix cannot conflict with them.
+const resultPrefix = "result:"
+
+func isResult(path string) bool {
+	return strings.HasPrefix(path, resultPrefix)
+}
 
-	loaded := make(map[string]*Vertex)
-	for len(unvisited) > 0 {
-		path, _ := pop(unvisited)
+// load reads the vertices of each head and all of their inputs. The returned
+// order is a topological sort of the vertices produced by a depth-first
+// traversal that visits inputs in the order they are declared. This keeps the
+// order stable between evaluations and guarantees the result vertices of the
+// heads are last.
+func load(heads []head) (map[string]*Vertex, []string, error) {
+	var (
+		loaded   = make(map[string]*Vertex)
+		visiting = make(map[string]struct{})
+		order    []string
+
+		// stack is the chain of vertices currently being visited.
+		stack []link
+	)
+
+	fail := func(err error) error {
+		return &vertexError{chain: slices.Clone(stack), err: err}
+	}
+
+	var visit func(path string) error
+	visit = func(path string) error {
+		if _, ok := loaded[path]; ok {
+			// Already visited.
+			return nil
+		} else if _, ok := visiting[path]; ok {
+			return fail(fmt.Errorf("cycle detected at %s", path))
+		}
+		visiting[path] = struct{}{}
+		stack = append(stack, link{path: path, input: -1})
 
 		data, err := os.ReadFile(path)
 		if err != nil {
-			return nil, nil, err
+			return fail(fmt.Errorf("missing vertex: %w", err))
 		}
 
 		v := &Vertex{}
 		if err := json.Unmarshal(data, v); err != nil {
-			return nil, nil, err
+			return fail(fmt.Errorf("invalid vertex: %w", err))
 		}
+		stack[len(stack)-1] = newLink(path, v, -1)
 
-		for _, input := range v.Op.Inputs {
-			inputPath := input.Digest
-
-			// Store the order we are loading files.
-			// We add this even if the file has been loaded before because
-			// we want to capture the full reverse load order.
-			order = append(order, inputPath)
-
-			// Check if we have already loaded the file.
-			if _, ok := loaded[inputPath]; ok {
-				// Already visited.
-				continue
+		for i, input := range v.Op.Inputs {
+			stack[len(stack)-1].input = i
+			if err := visit(input.Digest); err != nil {
+				return err
 			}
-			unvisited[inputPath] = struct{}{}
 		}
+
+		stack = stack[:len(stack)-1]
+		delete(visiting, path)
 		loaded[path] = v
+		order = append(order, path)
+		return nil
 	}
 
-	reverse(order)
+	for _, h := range heads {
+		if err := visit(h.path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, h := range heads {
+		outputs, _ := json.Marshal(map[string]string{h.name: h.check})
+		meta := &dockerfile.Metadata{
+			Description: map[string]string{
+				dockerfile.OutputsKey: string(outputs),
+			},
+		}
 
-	if len(order) > 0 {
-		loaded["result"] = &Vertex{
+		p := resultPrefix + h.name
+		if _, ok := loaded[p]; ok {
+			return nil, nil, fmt.Errorf("duplicate output %q", h.name)
+		}
+		loaded[p] = &Vertex{
 			Op: &pb.Op{
 				Inputs: []*pb.Input{
-					{Digest: order[len(order)-1]},
+					{Digest: h.path},
 				},
 			},
+			Meta: meta,
 		}
-		order = append(order, "result")
+		order = append(order, p)
 	}
 	return loaded, order, nil
 }
@@ -76,6 +130,11 @@ func convert(specs map[string]*Vertex, order []string) (*pb.Definition, error) {
 	}
 	outputs := make(map[string]*pb.Input)
 
+	source := &pb.Source{
+		Locations: make(map[string]*pb.Locations),
+	}
+	files := make(map[string]int32)
+
 	for _, path := range order {
 		if _, ok := outputs[path]; ok {
 			continue
@@ -83,11 +142,19 @@ func convert(specs map[string]*Vertex, order []string) (*pb.Definition, error) {
 
 		v := specs[path]
 		if v == nil {
-			return nil, errors.New("cycle detected")
+			return nil, errorAt(specs, path, -1, errors.New("vertex is missing from the graph"))
+		}
+
+		if v.Op.Op == nil && (!isResult(path) || len(v.Op.Inputs) > 1) {
+			return nil, errorAt(specs, path, -1, errors.New("vertex has no operation and cannot be represented in llb"))
 		}
 
 		for i, inp := range v.Op.Inputs {
-			v.Op.Inputs[i] = outputs[inp.Digest].CloneVT()
+			out, ok := outputs[inp.Digest]
+			if !ok {
+				return nil, errorAt(specs, path, i, fmt.Errorf("input refers to %s which has not been converted", inp.Digest))
+			}
+			v.Op.Inputs[i] = out.CloneVT()
 			v.Op.Inputs[i].Index = inp.Index
 		}
 
@@ -108,21 +175,129 @@ func convert(specs map[string]*Vertex, order []string) (*pb.Definition, error) {
 			v.Meta.Description = map[string]string{}
 		}
 
+		if name, ok := v.Meta.Description[dockerfile.DefaultNameKey]; ok {
+			delete(v.Meta.Description, dockerfile.DefaultNameKey)
+			if _, ok := v.Meta.Description["llb.customname"]; !ok {
+				v.Meta.Description["llb.customname"] = name
+			}
+		}
+
 		src, _ := protojson.Marshal(v.Op)
 		v.Meta.Description["llb.source"] = string(src)
 		if v.Meta != nil {
 			def.Metadata[out.Digest] = &pb.OpMetadata{
-				Description: v.Meta.Description,
+				Description:   v.Meta.Description,
+				ProgressGroup: toProgressGroup(v.Meta.ProgressGroup),
 			}
 		}
+
+		if locs := addLocations(source, files, v.Meta.Locations); locs != nil {
+			source.Locations[out.Digest] = locs
+		}
 		outputs[path] = out
 	}
+
+	if len(source.Infos) > 0 {
+		def.Source = source
+	}
 	return def, nil
 }
 
-func normalizeAndOptimize(specs map[string]*Vertex, order []string) {
+func toProgressGroup(pg *dockerfile.ProgressGroup) *pb.ProgressGroup {
+	if pg == nil {
+		return nil
+	}
+	return &pb.ProgressGroup{
+		Id:   pg.ID,
+		Name: pg.Name,
+		Weak: pg.Weak,
+	}
+}
+
+// addLocations adds the files of the locations to the source map and
+// returns the locations in the format used by the source map.
+func addLocations(source *pb.Source, files map[string]int32, locations []*dockerfile.Location) *pb.Locations {
+	if len(locations) == 0 {
+		return nil
+	}
+
+	locs := &pb.Locations{}
+	for _, loc := range locations {
+		i, ok := files[loc.File]
+		if !ok {
+			// The contents are included when the file can be read so
+			// the location is shown with the surrounding code.
+			data, _ := os.ReadFile(loc.File)
+
+			i = int32(len(source.Infos))
+			source.Infos = append(source.Infos, &pb.SourceInfo{
+				Filename: loc.File,
+				Data:     data,
+				Language: "Nix",
+			})
+			files[loc.File] = i
+		}
+
+		pos := &pb.Position{
+			Line:      loc.Line,
+			Character: max(loc.Column-1, 0),
+		}
+		locs.Locations = append(locs.Locations, &pb.Location{
+			SourceIndex: i,
+			Ranges: []*pb.Range{
+				{Start: pos, End: pos},
+			},
+		})
+	}
+	return locs
+}
+
+func normalizeAndOptimize(specs map[string]*Vertex, order []string) []string {
 	injectInferredMergeOp(specs, order)
+	order = flattenMerges(specs, order)
 	unrollTrivialMerges(specs, order)
+	order = eliminateCommonSubexpressions(specs, order)
+	order = coalesceFileOps(specs, order)
+	return pruneUnreachable(specs, order)
+}
+
+// pruneUnreachable removes the vertices that are not used by any of
+// the heads. These are left behind by the other passes and by library
+// functions whose results are never used. Inputs that are missing from
+// the graph are skipped so convert can report them.
+func pruneUnreachable(specs map[string]*Vertex, order []string) []string {
+	reachable := make(map[string]struct{})
+
+	var visit func(path string)
+	visit = func(path string) {
+		if _, ok := reachable[path]; ok {
+			return
+		}
+		reachable[path] = struct{}{}
+
+		v, ok := specs[path]
+		if !ok {
+			return
+		}
+
+		for _, inp := range v.Op.Inputs {
+			visit(inp.Digest)
+		}
+	}
+
+	for _, p := range order {
+		if isResult(p) {
+			visit(p)
+		}
+	}
+
+	return slices.DeleteFunc(order, func(p string) bool {
+		if _, ok := reachable[p]; !ok {
+			delete(specs, p)
+			return true
+		}
+		return false
+	})
 }
 
 func injectInferredMergeOp(specs map[string]*Vertex, order []string) {
@@ -136,7 +311,7 @@ func injectInferredMergeOp(specs map[string]*Vertex, order []string) {
 		v := specs[p]
 		for _, inp := range v.Op.Inputs {
 			vinp := specs[inp.Digest]
-			if vinp.Op.Op == nil {
+			if vinp != nil && vinp.Op.Op == nil {
 				inputs := make([]*pb.MergeInput, len(vinp.Op.Inputs))
 				for i := range inputs {
 					inputs[i] = &pb.MergeInput{Input: int64(i)}
@@ -151,12 +326,137 @@ func injectInferredMergeOp(specs map[string]*Vertex, order []string) {
 	}
 }
 
+// flattenMerges folds merge ops into the merge ops that use them when
+// nothing else references their result. The layers of the nested merge
+// take the place of the nested merge so the layer order is preserved.
+//
+// Merges without any inputs are equivalent to scratch. Buildkit rejects
+// them so references to them are replaced with scratch and the merges
+// are removed. A result that refers to scratch is left without any inputs.
+func flattenMerges(specs map[string]*Vertex, order []string) []string {
+	refs := make(map[string]int)
+	for _, p := range order {
+		for _, inp := range specs[p].Op.Inputs {
+			refs[inp.Digest]++
+		}
+	}
+
+	removed := make(map[string]struct{})
+	for _, p := range order {
+		v := specs[p]
+		for k := len(v.Op.Inputs) - 1; k >= 0; k-- {
+			if isEmptyMerge(specs[v.Op.Inputs[k].Digest]) {
+				removeInput(v, k)
+			}
+		}
+
+		if merge := v.Op.GetMerge(); merge != nil {
+			var (
+				inputs      []*pb.Input
+				mergeInputs []*pb.MergeInput
+			)
+			for _, mi := range merge.Inputs {
+				inp := v.Op.Inputs[mi.Input]
+				vinp := specs[inp.Digest]
+				if refs[inp.Digest] != 1 || inp.Index != 0 || vinp == nil ||
+					vinp.Op.GetMerge() == nil || !canFuse(vinp, v) {
+					mergeInputs = append(mergeInputs, &pb.MergeInput{Input: int64(len(inputs))})
+					inputs = append(inputs, inp)
+					continue
+				}
+
+				for _, nested := range vinp.Op.GetMerge().Inputs {
+					mergeInputs = append(mergeInputs, &pb.MergeInput{Input: int64(len(inputs))})
+					inputs = append(inputs, vinp.Op.Inputs[nested.Input].CloneVT())
+				}
+				fuseMetadata(vinp, v)
+				removed[inp.Digest] = struct{}{}
+			}
+			v.Op.Inputs = inputs
+			merge.Inputs = mergeInputs
+
+			if v.Meta != nil {
+				if _, ok := v.Meta.Description[dockerfile.DefaultNameKey]; ok {
+					v.Meta.Description[dockerfile.DefaultNameKey] = dockerfile.MergeName(len(mergeInputs))
+				}
+			}
+		}
+
+		if isEmptyMerge(v) {
+			removed[p] = struct{}{}
+		}
+	}
+
+	for p := range removed {
+		delete(specs, p)
+	}
+	return slices.DeleteFunc(order, func(p string) bool {
+		_, ok := removed[p]
+		return ok
+	})
+}
+
+func isEmptyMerge(v *Vertex) bool {
+	if v == nil {
+		return false
+	}
+	merge := v.Op.GetMerge()
+	return merge != nil && len(merge.Inputs) == 0
+}
+
+// removeInput removes the input at index k from the vertex. References
+// to the removed input are replaced with scratch and the references
+// to later inputs are shifted down.
+func removeInput(v *Vertex, k int) {
+	remap := func(i int64) int64 {
+		switch {
+		case i == int64(k):
+			return -1
+		case i > int64(k):
+			return i - 1
+		default:
+			return i
+		}
+	}
+
+	v.Op.Inputs = slices.Delete(v.Op.Inputs, k, k+1)
+	switch op := v.Op.Op.(type) {
+	case *pb.Op_Exec:
+		for _, m := range op.Exec.Mounts {
+			if m.Input >= 0 {
+				m.Input = remap(m.Input)
+			}
+		}
+	case *pb.Op_File:
+		for _, action := range op.File.Actions {
+			remapFileAction(action, remap)
+		}
+	case *pb.Op_Merge:
+		op.Merge.Inputs = slices.DeleteFunc(op.Merge.Inputs, func(mi *pb.MergeInput) bool {
+			return mi.Input == int64(k)
+		})
+		for _, mi := range op.Merge.Inputs {
+			mi.Input = remap(mi.Input)
+		}
+	case *pb.Op_Diff:
+		if lower := op.Diff.Lower; lower != nil && lower.Input >= 0 {
+			lower.Input = remap(lower.Input)
+		}
+		if upper := op.Diff.Upper; upper != nil && upper.Input >= 0 {
+			upper.Input = remap(upper.Input)
+		}
+	}
+}
+
 func unrollTrivialMerges(specs map[string]*Vertex, order []string) {
 	for _, p := range order {
 		v := specs[p]
 		for _, inp := range v.Op.Inputs {
 			for {
 				vinp := specs[inp.Digest]
+				if vinp == nil {
+					break
+				}
 				if op, ok := vinp.Op.Op.(*pb.Op_Merge); ok {
 					if len(op.Merge.Inputs) == 1 && op.Merge.Inputs[0].Input == 0 {
 						inp.Digest = vinp.Op.Inputs[0].Digest
@@ -170,12 +470,328 @@ func unrollTrivialMerges(specs map[string]*Vertex, order []string) {
 	}
 }
 
-func marshal(out io.Writer, infile string) error {
-	specs, order, err := load(infile)
+// eliminateCommonSubexpressions removes vertices that are identical to
+// a vertex earlier in the order. Vertices are identical when their ops,
+// including their resolved inputs, are the same. Since the order is
+// topological, the inputs of a vertex have already been rewritten to
+// their canonical vertex when the vertex itself is compared.
+func eliminateCommonSubexpressions(specs map[string]*Vertex, order []string) []string {
+	var (
+		canonical = make(map[string]string)
+		byKey     = make(map[string]string)
+		newOrder  = make([]string, 0, len(order))
+	)
+
+	for _, p := range order {
+		v := specs[p]
+		for _, inp := range v.Op.Inputs {
+			if c, ok := canonical[inp.Digest]; ok {
+				inp.Digest = c
+			}
+		}
+
+		key, err := v.Op.Marshal()
+		if err != nil {
+			// Let convert report the error.
+			newOrder = append(newOrder, p)
+			continue
+		}
+
+		if c, ok := byKey[string(key)]; ok {
+			mergeMetadata(specs[c], v)
+			canonical[p] = c
+			delete(specs, p)
+			continue
+		}
+		byKey[string(key)] = p
+		newOrder = append(newOrder, p)
+	}
+	return newOrder
+}
+
+// mergeMetadata copies the description from the duplicate vertex
+// into the canonical vertex. The existing description wins except for
+// the output names which are combined.
+func mergeMetadata(v, dup *Vertex) {
+	if dup.Meta == nil {
+		return
+	}
+
+	if v.Meta == nil {
+		v.Meta = &dockerfile.Metadata{}
+	}
+	v.Meta.Locations = appendLocations(v.Meta.Locations, dup.Meta.Locations)
+	if v.Meta.ProgressGroup == nil {
+		v.Meta.ProgressGroup = dup.Meta.ProgressGroup
+	}
+
+	if v.Meta.Description == nil {
+		v.Meta.Description = make(map[string]string)
+	}
+
+	for k, val := range dup.Meta.Description {
+		existing, ok := v.Meta.Description[k]
+		switch {
+		case !ok:
+			v.Meta.Description[k] = val
+		case k == dockerfile.OutputsKey:
+			// Each output keeps its own check.
+			var outputs, other map[string]string
+			_ = json.Unmarshal([]byte(existing), &outputs)
+			_ = json.Unmarshal([]byte(val), &other)
+			maps.Copy(outputs, other)
+
+			combined, _ := json.Marshal(outputs)
+			v.Meta.Description[k] = string(combined)
+		}
+	}
+}
+
+// coalesceFileOps fuses chains of file ops into a single file op with
+// multiple actions. A file op is only fused into the file op that uses it
+// when nothing else references its result.
+func coalesceFileOps(specs map[string]*Vertex, order []string) []string {
+	refs := make(map[string]int)
+	for _, p := range order {
+		for _, inp := range specs[p].Op.Inputs {
+			refs[inp.Digest]++
+		}
+	}
+
+	removed := make(map[string]struct{})
+	for _, p := range order {
+		v := specs[p]
+		if v.Op.GetFile() == nil {
+			continue
+		}
+
+		for {
+			k := slices.IndexFunc(v.Op.Inputs, func(inp *pb.Input) bool {
+				vinp := specs[inp.Digest]
+				return refs[inp.Digest] == 1 && inp.Index == 0 && vinp != nil &&
+					vinp.Op.GetFile() != nil && hasOutput(vinp.Op.GetFile()) &&
+					canFuse(vinp, v)
+			})
+			if k < 0 {
+				break
+			}
+
+			dgst := v.Op.Inputs[k].Digest
+			fuseFileOps(specs[dgst], v, k)
+			removed[dgst] = struct{}{}
+			delete(specs, dgst)
+		}
+	}
+
+	return slices.DeleteFunc(order, func(p string) bool {
+		_, ok := removed[p]
+		return ok
+	})
+}
+
+// hasOutput reports whether one of the actions produces the output
+// of the file op.
+func hasOutput(file *pb.FileOp) bool {
+	return slices.ContainsFunc(file.Actions, func(action *pb.FileAction) bool {
+		return action.Output == 0
+	})
+}
+
+// canFuse reports whether the op in a can be fused into the op in b
+// without losing any information about either op.
+func canFuse(a, b *Vertex) bool {
+	if !proto.Equal(a.Op.Platform, b.Op.Platform) ||
+		!proto.Equal(a.Op.Constraints, b.Op.Constraints) {
+		return false
+	}
+
+	if a.Meta == nil || b.Meta == nil {
+		return true
+	}
+
+	if a.Meta.ProgressGroup != nil && b.Meta.ProgressGroup != nil &&
+		*a.Meta.ProgressGroup != *b.Meta.ProgressGroup {
+		return false
+	}
+
+	for k, v := range a.Meta.Description {
+		if k == "llb.customname" || k == dockerfile.DefaultNameKey {
+			// Names are combined.
+			continue
+		}
+
+		if other, ok := b.Meta.Description[k]; ok && other != v {
+			return false
+		}
+	}
+	return true
+}
+
+// fuseFileOps prepends the actions of a to the file op in b. The input
+// at index k of b refers to the result of a. Indexes in both ops are
+// remapped to the combined inputs and actions.
+func fuseFileOps(a, b *Vertex, k int) {
+	var (
+		aFile, bFile = a.Op.GetFile(), b.Op.GetFile()
+		nA, nB       = int64(len(a.Op.Inputs)), int64(len(b.Op.Inputs))
+		nC           = nA + nB - 1
+		numActions   = int64(len(aFile.Actions))
+	)
+
+	aOut := int64(slices.IndexFunc(aFile.Actions, func(action *pb.FileAction) bool {
+		return action.Output == 0
+	}))
+
+	remapA := func(i int64) int64 {
+		if i < nA {
+			return i
+		}
+		return nC + i - nA
+	}
+	remapB := func(i int64) int64 {
+		switch {
+		case i < 0:
+			return i
+		case i == int64(k):
+			return nC + aOut
+		case i < nB:
+			if i > int64(k) {
+				i--
+			}
+			return nA + i
+		default:
+			return nC + numActions + i - nB
+		}
+	}
+
+	actions := make([]*pb.FileAction, 0, len(aFile.Actions)+len(bFile.Actions))
+	for _, action := range aFile.Actions {
+		remapFileAction(action, remapA)
+		action.Output = -1
+		actions = append(actions, action)
+	}
+	for _, action := range bFile.Actions {
+		remapFileAction(action, remapB)
+		actions = append(actions, action)
+	}
+	bFile.Actions = actions
+
+	inputs := slices.Clone(a.Op.Inputs)
+	inputs = append(inputs, b.Op.Inputs[:k]...)
+	inputs = append(inputs, b.Op.Inputs[k+1:]...)
+	b.Op.Inputs = inputs
+
+	fuseMetadata(a, b)
+}
+
+func remapFileAction(action *pb.FileAction, remap func(int64) int64) {
+	if action.Input >= 0 {
+		action.Input = remap(action.Input)
+	}
+	if action.SecondaryInput >= 0 {
+		action.SecondaryInput = remap(action.SecondaryInput)
+	}
+
+	var owner *pb.ChownOpt
+	switch a := action.Action.(type) {
+	case *pb.FileAction_Copy:
+		owner = a.Copy.Owner
+	case *pb.FileAction_Mkfile:
+		owner = a.Mkfile.Owner
+	case *pb.FileAction_Mkdir:
+		owner = a.Mkdir.Owner
+	case *pb.FileAction_Symlink:
+		owner = a.Symlink.Owner
+	}
+
+	if owner == nil {
+		return
+	}
+
+	for _, user := range []*pb.UserOpt{owner.User, owner.Group} {
+		if byName := user.GetByName(); byName != nil && byName.Input >= 0 {
+			byName.Input = remap(byName.Input)
+		}
+	}
+}
+
+// fuseMetadata combines the description of a into b. The custom names
+// of both ops are joined so neither is lost in the progress output.
+func fuseMetadata(a, b *Vertex) {
+	if a.Meta == nil {
+		return
+	}
+
+	if b.Meta == nil {
+		b.Meta = &dockerfile.Metadata{}
+	}
+	b.Meta.Locations = appendLocations(slices.Clone(a.Meta.Locations), b.Meta.Locations)
+	if b.Meta.ProgressGroup == nil {
+		b.Meta.ProgressGroup = a.Meta.ProgressGroup
+	}
+
+	if b.Meta.Description == nil {
+		b.Meta.Description = make(map[string]string)
+	}
+
+	// An op without a custom name is shown with its default name
+	// when it is combined with an op that has one.
+	_, customA := a.Meta.Description["llb.customname"]
+	_, customB := b.Meta.Description["llb.customname"]
+	if customA || customB {
+		b.Meta.Description["llb.customname"] = joinNames(displayName(a), displayName(b))
+	}
+
+	for k, v := range a.Meta.Description {
+		other, ok := b.Meta.Description[k]
+		switch {
+		case !ok:
+			b.Meta.Description[k] = v
+		case k == dockerfile.DefaultNameKey:
+			b.Meta.Description[k] = joinNames(v, other)
+		}
+	}
+}
+
+// displayName returns the name of the op shown in the progress output.
+func displayName(v *Vertex) string {
+	if v.Meta == nil {
+		return ""
+	} else if name, ok := v.Meta.Description["llb.customname"]; ok {
+		return name
+	}
+	return v.Meta.Description[dockerfile.DefaultNameKey]
+}
+
+func joinNames(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case b == "":
+		return a
+	default:
+		return a + ", " + b
+	}
+}
+
+// appendLocations appends the locations that are not already present.
+func appendLocations(locations []*dockerfile.Location, other []*dockerfile.Location) []*dockerfile.Location {
+	for _, loc := range other {
+		if !slices.ContainsFunc(locations, func(l *dockerfile.Location) bool {
+			return *l == *loc
+		}) {
+			locations = append(locations, loc)
+		}
+	}
+	return locations
+}
+
+func marshal(out io.Writer, heads []head) error {
+	specs, order, err := load(heads)
 	if err != nil {
 		return err
 	}
-	normalizeAndOptimize(specs, order)
+	order = normalizeAndOptimize(specs, order)
 
 	def, err := convert(specs, order)
 	if err != nil {
@@ -196,19 +812,63 @@ func marshal(out io.Writer, infile string) error {
 func main() {
 	app := cli.NewApp()
 	app.Usage = "marshal"
+	app.Flags = []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "head",
+			Usage: "add a named output with the format name=input",
+		},
+		&cli.StringSliceFlag{
+			Name:  "check",
+			Usage: "mark an output as a check with the format [name=]check",
+		},
+	}
 	app.Action = func(c *cli.Context) error {
-		if c.NArg() < 1 {
-			return errors.New("expected at least one argument")
-		} else if c.NArg() > 2 {
+		var heads []head
+		for _, arg := range c.StringSlice("head") {
+			name, input, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				return fmt.Errorf("invalid head %q: expected name=input", arg)
+			}
+			heads = append(heads, head{
+				name: name,
+				path: filepath.Join(os.ExpandEnv(input), "vertex.json"),
+			})
+		}
+
+		args := c.Args().Slice()
+		if len(heads) == 0 {
+			if len(args) < 1 {
+				return errors.New("expected at least one argument")
+			}
+			heads = append(heads, head{
+				name: "default",
+				path: filepath.Join(os.ExpandEnv(args[0]), "vertex.json"),
+			})
+			args = args[1:]
+		}
+
+		if len(args) > 1 {
 			return errors.New("too many arguments")
 		}
 
-		args := c.Args()
-		infile := filepath.Join(os.ExpandEnv(args.Get(0)), "vertex.json")
+		for _, arg := range c.StringSlice("check") {
+			name, check, ok := strings.Cut(arg, "=")
+			if !ok {
+				name, check = "default", arg
+			}
+
+			i := slices.IndexFunc(heads, func(h head) bool {
+				return h.name == name
+			})
+			if i < 0 {
+				return fmt.Errorf("check %q refers to unknown output %q", check, name)
+			}
+			heads[i].check = check
+		}
 
 		out := os.Stdout
-		if c.NArg() == 2 {
-			outfile := os.ExpandEnv(args.Get(1))
+		if len(args) == 1 {
+			outfile := os.ExpandEnv(args[0])
 			f, err := os.Create(outfile)
 			if err != nil {
 				return err
@@ -217,7 +877,7 @@ func main() {
 
 			out = f
 		}
-		return marshal(out, infile)
+		return marshal(out, heads)
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -226,22 +886,25 @@ func main() {
 	}
 }
 
-func pop[K comparable, V any](set map[K]V) (k K, v V) {
-	for k, v = range set {
-		delete(set, k)
-		return k, v
+// marshalJSON writes the definition along with the spec version
+// so the frontend can check it before decoding the definition.
+func marshalJSON(def *pb.Definition) ([]byte, error) {
+	src, err := protojson.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(src, &fields); err != nil {
+		return nil, err
 	}
-	return k, v
-}
 
-func reverse[T any](arr []T) {
-	for i, j := 0, len(arr)-1; i < j; i, j = i+1, j-1 {
-		arr[i], arr[j] = arr[j], arr[i]
+	fields["version"], err = json.Marshal(dockerfile.SpecVersion)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func marshalJSON(def *pb.Definition) ([]byte, error) {
-	src, err := protojson.Marshal(def)
+	src, err = json.Marshal(fields)
 	if err != nil {
 		return nil, err
 	}
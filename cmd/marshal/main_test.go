@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/jsternberg/nix-frontend/dockerfile"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+)
+
+func writeVertex(t *testing.T, dir string, v *Vertex) string {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(dir, "vertex.json")
+	if err := os.WriteFile(fpath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fpath
+}
+
+// TestSharedResultKeepsChecksPerOutput checks that outputs referring to
+// the same vertex do not share the check of one of the outputs.
+func TestSharedResultKeepsChecksPerOutput(t *testing.T) {
+	src := writeVertex(t, t.TempDir(), &Vertex{
+		Op: &pb.Op{
+			Op: &pb.Op_Source{
+				Source: &pb.SourceOp{Identifier: "docker-image://docker.io/library/alpine:latest"},
+			},
+		},
+	})
+
+	specs, order, err := load([]head{
+		{name: "default", path: src},
+		{name: "test", path: src, check: "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order = normalizeAndOptimize(specs, order)
+
+	def, err := convert(specs, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []*pb.OpMetadata
+	for _, meta := range def.Metadata {
+		if _, ok := meta.Description[dockerfile.OutputsKey]; ok {
+			results = append(results, meta)
+		}
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected a single result vertex, got %d", len(results))
+	}
+
+	meta := results[0]
+	if check, ok := meta.Description[dockerfile.CheckKey]; ok {
+		t.Errorf("unexpected check %q on the shared result vertex", check)
+	}
+
+	var outputs map[string]string
+	if err := json.Unmarshal([]byte(meta.Description[dockerfile.OutputsKey]), &outputs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"default": "", "test": "test"}
+	if len(outputs) != len(want) {
+		t.Fatalf("expected outputs %v, got %v", want, outputs)
+	}
+	for name, check := range want {
+		if got, ok := outputs[name]; !ok || got != check {
+			t.Errorf("expected output %q to have check %q, got %q", name, check, got)
+		}
+	}
+}
+
+// TestMissingInputIsReported checks that an input that is missing from
+// the graph is reported by convert instead of panicking in the passes.
+func TestMissingInputIsReported(t *testing.T) {
+	specs := map[string]*Vertex{
+		"exec": {
+			Op: &pb.Op{
+				Inputs: []*pb.Input{{Digest: "missing"}},
+				Op: &pb.Op_Exec{
+					Exec: &pb.ExecOp{
+						Meta:   &pb.Meta{Args: []string{"true"}},
+						Mounts: []*pb.Mount{{Input: 0, Dest: "/", Output: 0}},
+					},
+				},
+			},
+		},
+		"result:default": {
+			Op: &pb.Op{
+				Inputs: []*pb.Input{{Digest: "exec"}},
+			},
+		},
+	}
+	order := normalizeAndOptimize(specs, []string{"exec", "result:default"})
+
+	if _, err := convert(specs, order); err == nil {
+		t.Fatal("expected an error for the missing input")
+	}
+}
+
+func sourceVertex(identifier string) *Vertex {
+	return &Vertex{
+		Op: &pb.Op{
+			Op: &pb.Op_Source{
+				Source: &pb.SourceOp{Identifier: identifier},
+			},
+		},
+	}
+}
+
+func fileVertex(inputs []*pb.Input, actions ...*pb.FileAction) *Vertex {
+	return &Vertex{
+		Op: &pb.Op{
+			Inputs: inputs,
+			Op: &pb.Op_File{
+				File: &pb.FileOp{Actions: actions},
+			},
+		},
+	}
+}
+
+// fileAction returns a copy action when it has a secondary input and
+// a mkdir action otherwise.
+func fileAction(input, secondaryInput, output int64) *pb.FileAction {
+	action := &pb.FileAction{
+		Input:          input,
+		SecondaryInput: secondaryInput,
+		Output:         output,
+	}
+	if secondaryInput >= 0 {
+		action.Action = &pb.FileAction_Copy{
+			Copy: &pb.FileActionCopy{Src: "/", Dest: "/"},
+		}
+	} else {
+		action.Action = &pb.FileAction_Mkdir{
+			Mkdir: &pb.FileActionMkDir{Path: "/dir"},
+		}
+	}
+	return action
+}
+
+func inputs(digests ...string) []*pb.Input {
+	inputs := make([]*pb.Input, len(digests))
+	for i, dgst := range digests {
+		inputs[i] = &pb.Input{Digest: dgst}
+	}
+	return inputs
+}
+
+func inputDigests(v *Vertex) []string {
+	digests := make([]string, len(v.Op.Inputs))
+	for i, inp := range v.Op.Inputs {
+		digests[i] = inp.Digest
+	}
+	return digests
+}
+
+// fileActionIndexes returns the input, secondary input and output of
+// each action in the file op.
+func fileActionIndexes(v *Vertex) [][3]int64 {
+	var indexes [][3]int64
+	for _, action := range v.Op.GetFile().GetActions() {
+		indexes = append(indexes, [3]int64{action.Input, action.SecondaryInput, action.Output})
+	}
+	return indexes
+}
+
+func TestCoalesceFileOps(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		specs   map[string]*Vertex
+		order   []string
+		want    []string
+		head    string
+		inputs  []string
+		actions [][3]int64
+	}{
+		{
+			name: "Chain",
+			specs: map[string]*Vertex{
+				"a": fileVertex(nil, fileAction(-1, -1, 0)),
+				"b": fileVertex(inputs("a"), fileAction(0, -1, 0)),
+				"c": fileVertex(inputs("b"), fileAction(0, -1, 0)),
+			},
+			order:   []string{"a", "b", "c"},
+			want:    []string{"c"},
+			head:    "c",
+			inputs:  []string{},
+			actions: [][3]int64{{-1, -1, -1}, {0, -1, -1}, {1, -1, 0}},
+		},
+		{
+			name: "SharedIntermediate",
+			specs: map[string]*Vertex{
+				"a": fileVertex(nil, fileAction(-1, -1, 0)),
+				"b": fileVertex(inputs("a"), fileAction(0, -1, 0)),
+				"c": fileVertex(inputs("a"), fileAction(0, -1, 0)),
+			},
+			order:   []string{"a", "b", "c"},
+			want:    []string{"a", "b", "c"},
+			head:    "b",
+			inputs:  []string{"a"},
+			actions: [][3]int64{{0, -1, 0}},
+		},
+		{
+			name: "SecondaryInput",
+			specs: map[string]*Vertex{
+				"base": sourceVertex("docker-image://docker.io/library/alpine:latest"),
+				"img":  sourceVertex("docker-image://docker.io/library/busybox:latest"),
+				"a":    fileVertex(inputs("base"), fileAction(0, -1, 0)),
+				"b":    fileVertex(inputs("img", "a"), fileAction(1, 0, 0)),
+			},
+			order:   []string{"base", "img", "a", "b"},
+			want:    []string{"base", "img", "b"},
+			head:    "b",
+			inputs:  []string{"base", "img"},
+			actions: [][3]int64{{0, -1, -1}, {2, 1, 0}},
+		},
+		{
+			name: "NonZeroOutput",
+			specs: map[string]*Vertex{
+				"a": fileVertex(nil, fileAction(-1, -1, 0), fileAction(-1, -1, 1)),
+				"b": fileVertex([]*pb.Input{{Digest: "a", Index: 1}}, fileAction(0, -1, 0)),
+			},
+			order:   []string{"a", "b"},
+			want:    []string{"a", "b"},
+			head:    "b",
+			inputs:  []string{"a"},
+			actions: [][3]int64{{0, -1, 0}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			order := coalesceFileOps(tt.specs, tt.order)
+			if !slices.Equal(order, tt.want) {
+				t.Fatalf("expected order %v, got %v", tt.want, order)
+			}
+
+			v := tt.specs[tt.head]
+			if got := inputDigests(v); !slices.Equal(got, tt.inputs) {
+				t.Errorf("expected inputs %v, got %v", tt.inputs, got)
+			}
+			if got := fileActionIndexes(v); !slices.Equal(got, tt.actions) {
+				t.Errorf("expected actions %v, got %v", tt.actions, got)
+			}
+		})
+	}
+}
+
+func mergeVertex(digests ...string) *Vertex {
+	mergeInputs := make([]*pb.MergeInput, len(digests))
+	for i := range mergeInputs {
+		mergeInputs[i] = &pb.MergeInput{Input: int64(i)}
+	}
+	return &Vertex{
+		Op: &pb.Op{
+			Inputs: inputs(digests...),
+			Op: &pb.Op_Merge{
+				Merge: &pb.MergeOp{Inputs: mergeInputs},
+			},
+		},
+	}
+}
+
+func mergeInputIndexes(v *Vertex) []int64 {
+	var indexes []int64
+	for _, mi := range v.Op.GetMerge().GetInputs() {
+		indexes = append(indexes, mi.Input)
+	}
+	return indexes
+}
+
+func TestFlattenMerges(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		specs  map[string]*Vertex
+		order  []string
+		want   []string
+		head   string
+		inputs []string
+		merge  []int64
+	}{
+		{
+			name: "Nested",
+			specs: map[string]*Vertex{
+				"w":     sourceVertex("local://w"),
+				"x":     sourceVertex("local://x"),
+				"y":     sourceVertex("local://y"),
+				"z":     sourceVertex("local://z"),
+				"inner": mergeVertex("x", "y"),
+				"outer": mergeVertex("w", "inner", "z"),
+			},
+			order:  []string{"w", "x", "y", "z", "inner", "outer"},
+			want:   []string{"w", "x", "y", "z", "outer"},
+			head:   "outer",
+			inputs: []string{"w", "x", "y", "z"},
+			merge:  []int64{0, 1, 2, 3},
+		},
+		{
+			name: "SharedNested",
+			specs: map[string]*Vertex{
+				"w":     sourceVertex("local://w"),
+				"x":     sourceVertex("local://x"),
+				"y":     sourceVertex("local://y"),
+				"inner": mergeVertex("x", "y"),
+				"outer": mergeVertex("w", "inner"),
+				"other": fileVertex(inputs("inner"), fileAction(0, -1, 0)),
+			},
+			order:  []string{"w", "x", "y", "inner", "outer", "other"},
+			want:   []string{"w", "x", "y", "inner", "outer", "other"},
+			head:   "outer",
+			inputs: []string{"w", "inner"},
+			merge:  []int64{0, 1},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			order := flattenMerges(tt.specs, tt.order)
+			if !slices.Equal(order, tt.want) {
+				t.Fatalf("expected order %v, got %v", tt.want, order)
+			}
+
+			v := tt.specs[tt.head]
+			if got := inputDigests(v); !slices.Equal(got, tt.inputs) {
+				t.Errorf("expected inputs %v, got %v", tt.inputs, got)
+			}
+			if got := mergeInputIndexes(v); !slices.Equal(got, tt.merge) {
+				t.Errorf("expected merge inputs %v, got %v", tt.merge, got)
+			}
+		})
+	}
+}
+
+// TestFlattenEmptyMerges checks that references to an empty merge are
+// replaced with scratch without shifting the references to the other
+// inputs onto the wrong input.
+func TestFlattenEmptyMerges(t *testing.T) {
+	t.Run("Diff", func(t *testing.T) {
+		specs := map[string]*Vertex{
+			"empty": mergeVertex(),
+			"upper": sourceVertex("local://upper"),
+			"diff": {
+				Op: &pb.Op{
+					Inputs: inputs("empty", "upper"),
+					Op: &pb.Op_Diff{
+						Diff: &pb.DiffOp{
+							Lower: &pb.LowerDiffInput{Input: 0},
+							Upper: &pb.UpperDiffInput{Input: 1},
+						},
+					},
+				},
+			},
+		}
+
+		order := flattenMerges(specs, []string{"empty", "upper", "diff"})
+		if want := []string{"upper", "diff"}; !slices.Equal(order, want) {
+			t.Fatalf("expected order %v, got %v", want, order)
+		}
+
+		v := specs["diff"]
+		if got, want := inputDigests(v), []string{"upper"}; !slices.Equal(got, want) {
+			t.Errorf("expected inputs %v, got %v", want, got)
+		}
+
+		diff := v.Op.GetDiff()
+		if diff.Lower.Input != -1 || diff.Upper.Input != 0 {
+			t.Errorf("expected lower -1 and upper 0, got lower %d and upper %d", diff.Lower.Input, diff.Upper.Input)
+		}
+	})
+
+	t.Run("Exec", func(t *testing.T) {
+		specs := map[string]*Vertex{
+			"base":  sourceVertex("docker-image://docker.io/library/alpine:latest"),
+			"empty": mergeVertex(),
+			"cache": sourceVertex("local://cache"),
+			"exec": {
+				Op: &pb.Op{
+					Inputs: inputs("base", "empty", "cache"),
+					Op: &pb.Op_Exec{
+						Exec: &pb.ExecOp{
+							Meta: &pb.Meta{Args: []string{"true"}},
+							Mounts: []*pb.Mount{
+								{Input: 0, Dest: "/", Output: 0},
+								{Input: 1, Dest: "/empty", Output: -1},
+								{Input: 2, Dest: "/cache", Output: -1},
+								{Input: -1, Dest: "/tmp", Output: -1, MountType: pb.MountType_TMPFS},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		order := flattenMerges(specs, []string{"base", "empty", "cache", "exec"})
+		if want := []string{"base", "cache", "exec"}; !slices.Equal(order, want) {
+			t.Fatalf("expected order %v, got %v", want, order)
+		}
+
+		v := specs["exec"]
+		if got, want := inputDigests(v), []string{"base", "cache"}; !slices.Equal(got, want) {
+			t.Errorf("expected inputs %v, got %v", want, got)
+		}
+
+		var mounts []int64
+		for _, m := range v.Op.GetExec().Mounts {
+			mounts = append(mounts, m.Input)
+		}
+		if want := []int64{0, -1, 1, -1}; !slices.Equal(mounts, want) {
+			t.Errorf("expected mount inputs %v, got %v", want, mounts)
+		}
+	})
+}
+
+// TestScratchResult checks that a head that is scratch is written as a
+// result vertex without any inputs or operation.
+func TestScratchResult(t *testing.T) {
+	empty := writeVertex(t, t.TempDir(), mergeVertex())
+
+	specs, order, err := load([]head{{name: "default", path: empty}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order = normalizeAndOptimize(specs, order)
+
+	def, err := convert(specs, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(def.Def) != 1 {
+		t.Fatalf("expected only the result vertex, got %d vertices", len(def.Def))
+	}
+
+	var op pb.Op
+	if err := op.Unmarshal(def.Def[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(op.Inputs) != 0 || op.Op != nil {
+		t.Errorf("expected an empty result vertex, got %v", &op)
+	}
+
+	meta := def.Metadata[string(digest.FromBytes(def.Def[0]))]
+	if got, want := meta.GetDescription()[dockerfile.OutputsKey], `{"default":""}`; got != want {
+		t.Errorf("expected outputs %s, got %s", want, got)
+	}
+}
+
+// TestEliminateCommonSubexpressions checks that identical ops are merged
+// into the first of them in the order regardless of their metadata.
+func TestEliminateCommonSubexpressions(t *testing.T) {
+	newSpecs := func() map[string]*Vertex {
+		first := sourceVertex("docker-image://docker.io/library/alpine:latest")
+		first.Meta = &dockerfile.Metadata{
+			Description: map[string]string{
+				"llb.customname": "first",
+			},
+			Locations: []*dockerfile.Location{{File: "a.nix", Line: 1}},
+		}
+
+		second := sourceVertex("docker-image://docker.io/library/alpine:latest")
+		second.Meta = &dockerfile.Metadata{
+			Description: map[string]string{
+				"llb.customname": "second",
+				"extra":          "value",
+			},
+			Locations:     []*dockerfile.Location{{File: "b.nix", Line: 2}},
+			ProgressGroup: &dockerfile.ProgressGroup{ID: "group", Name: "group"},
+		}
+
+		return map[string]*Vertex{
+			"first":  first,
+			"second": second,
+			"user":   fileVertex(inputs("second"), fileAction(0, -1, 0)),
+		}
+	}
+
+	// Repeat the pass so a dependence on the iteration order of the
+	// descriptions would show up.
+	for range 10 {
+		specs := newSpecs()
+		order := eliminateCommonSubexpressions(specs, []string{"first", "second", "user"})
+		if want := []string{"first", "user"}; !slices.Equal(order, want) {
+			t.Fatalf("expected order %v, got %v", want, order)
+		}
+
+		if got := inputDigests(specs["user"]); !slices.Equal(got, []string{"first"}) {
+			t.Errorf("expected the user to refer to first, got %v", got)
+		}
+
+		meta := specs["first"].Meta
+		if got := meta.Description["llb.customname"]; got != "first" {
+			t.Errorf("expected the name of the first vertex, got %q", got)
+		}
+		if got := meta.Description["extra"]; got != "value" {
+			t.Errorf("expected the description of the duplicate to be copied, got %q", got)
+		}
+		if meta.ProgressGroup == nil || meta.ProgressGroup.ID != "group" {
+			t.Errorf("expected the progress group of the duplicate, got %v", meta.ProgressGroup)
+		}
+
+		want := []dockerfile.Location{{File: "a.nix", Line: 1}, {File: "b.nix", Line: 2}}
+		if len(meta.Locations) != len(want) {
+			t.Fatalf("expected locations %v, got %d locations", want, len(meta.Locations))
+		}
+		for i, loc := range meta.Locations {
+			if *loc != want[i] {
+				t.Errorf("expected location %v at %d, got %v", want[i], i, *loc)
+			}
+		}
+	}
+}
+
+// TestEliminateCommonSubexpressionsInputIndex checks that ops that
+// only differ in the output of their input are not merged.
+func TestEliminateCommonSubexpressionsInputIndex(t *testing.T) {
+	specs := map[string]*Vertex{
+		"files": fileVertex(nil, fileAction(-1, -1, 0), fileAction(-1, -1, 1)),
+		"a":     fileVertex([]*pb.Input{{Digest: "files", Index: 0}}, fileAction(0, -1, 0)),
+		"b":     fileVertex([]*pb.Input{{Digest: "files", Index: 1}}, fileAction(0, -1, 0)),
+	}
+
+	order := eliminateCommonSubexpressions(specs, []string{"files", "a", "b"})
+	if want := []string{"files", "a", "b"}; !slices.Equal(order, want) {
+		t.Fatalf("expected order %v, got %v", want, order)
+	}
+}
@@ -1,21 +1,69 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/containerd/platforms"
 	"github.com/jsternberg/nix-frontend/dockerfile"
 	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/gitutil"
+	"github.com/opencontainers/go-digest"
 )
 
 func convertSourceOp(in *dockerfile.SourceOp) (*pb.Op, error) {
+	var source *pb.SourceOp
+	switch {
+	case in.Git != nil:
+		var err error
+		source, err = convertGitSource(in.Git)
+		if err != nil {
+			return nil, err
+		}
+	case in.HTTP != nil:
+		var err error
+		source, err = convertHTTPSource(in.HTTP)
+		if err != nil {
+			return nil, err
+		}
+	case in.OCILayout != nil:
+		var err error
+		source, err = convertOCILayoutSource(in.OCILayout)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		source, err = convertGenericSource(in)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	op := &pb.Op{
+		Op: &pb.Op_Source{
+			Source: source,
+		},
+	}
+	if err := setPlatform(op, in.Platform, in.Constraints); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func convertGenericSource(in *dockerfile.SourceOp) (*pb.SourceOp, error) {
 	var attrs map[string]string
 	if len(in.Attributes) > 0 {
 		u, err := url.Parse(in.Identifier)
@@ -23,31 +71,294 @@ func convertSourceOp(in *dockerfile.SourceOp) (*pb.Op, error) {
 			return nil, err
 		}
 
+		prefix := u.Scheme
+		if prefix == "https" {
+			prefix = "http"
+		}
+
 		attrs = make(map[string]string)
 		for k, v := range in.Attributes {
-			attrs[fmt.Sprintf("%s.%s", u.Scheme, k)] = v
+			if prefix == "http" && !isHTTPAttr(k) {
+				return nil, fmt.Errorf("unknown attribute %q for http source %s", k, in.Identifier)
+			}
+			attrs[fmt.Sprintf("%s.%s", prefix, k)] = v
 		}
 	}
 
-	return &pb.Op{
-		Op: &pb.Op_Source{
-			Source: &pb.SourceOp{
-				Identifier: in.Identifier,
-				Attrs:      attrs,
-			},
-		},
+	if len(in.IncludePatterns) > 0 || len(in.ExcludePatterns) > 0 || in.SharedKey != "" {
+		if !strings.HasPrefix(in.Identifier, "local://") {
+			return nil, fmt.Errorf("patterns and shared keys are only supported for local sources: %s", in.Identifier)
+		}
+
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+
+		if err := setJSONAttr(attrs, pb.AttrIncludePatterns, in.IncludePatterns); err != nil {
+			return nil, err
+		}
+		if err := setJSONAttr(attrs, pb.AttrExcludePatterns, in.ExcludePatterns); err != nil {
+			return nil, err
+		}
+		if in.SharedKey != "" {
+			attrs[pb.AttrSharedKeyHint] = in.SharedKey
+		}
+	}
+
+	return &pb.SourceOp{
+		Identifier: in.Identifier,
+		Attrs:      attrs,
+	}, nil
+}
+
+// setJSONAttr sets the attribute to the json encoding of the list
+// when the list is not empty.
+func setJSONAttr(attrs map[string]string, k string, v []string) error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	attrs[k] = string(data)
+	return nil
+}
+
+func isHTTPAttr(k string) bool {
+	switch "http." + k {
+	case pb.AttrHTTPChecksum, pb.AttrHTTPFilename, pb.AttrHTTPPerm,
+		pb.AttrHTTPUID, pb.AttrHTTPGID, pb.AttrHTTPAuthHeaderSecret:
+		return true
+	}
+	return strings.HasPrefix("http."+k, pb.AttrHTTPHeaderPrefix)
+}
+
+func convertHTTPSource(in *dockerfile.HTTPSource) (*pb.SourceOp, error) {
+	u, err := url.Parse(in.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q for http source %s", u.Scheme, in.URL)
+	}
+
+	attrs := make(map[string]string)
+	if in.Checksum != "" {
+		dgst, err := digest.Parse(in.Checksum)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum for http source %s: %w", in.URL, err)
+		}
+		attrs[pb.AttrHTTPChecksum] = dgst.String()
+	}
+
+	if in.Filename != "" {
+		if strings.Contains(in.Filename, "/") {
+			return nil, fmt.Errorf("invalid filename %q for http source %s", in.Filename, in.URL)
+		}
+		attrs[pb.AttrHTTPFilename] = in.Filename
+	}
+
+	if in.Perm != "" {
+		perm, err := parseMode(in.Perm, 0)
+		if err != nil {
+			return nil, err
+		}
+		attrs[pb.AttrHTTPPerm] = "0" + strconv.FormatInt(int64(perm), 8)
+	}
+
+	if in.UID != 0 {
+		attrs[pb.AttrHTTPUID] = strconv.Itoa(in.UID)
+	}
+	if in.GID != 0 {
+		attrs[pb.AttrHTTPGID] = strconv.Itoa(in.GID)
+	}
+
+	if in.AuthHeaderSecret != "" {
+		attrs[pb.AttrHTTPAuthHeaderSecret] = in.AuthHeaderSecret
+	}
+	for k, v := range in.Headers {
+		attrs[pb.AttrHTTPHeaderPrefix+k] = v
+	}
+
+	return &pb.SourceOp{
+		Identifier: in.URL,
+		Attrs:      attrs,
+	}, nil
+}
+
+// convertOCILayoutSource creates an oci-layout source. The store and the
+// digest of the image are filled in by the frontend from the named build
+// context since they are only known by the client.
+func convertOCILayoutSource(in *dockerfile.OCILayoutSource) (*pb.SourceOp, error) {
+	if in.Context == "" {
+		return nil, errors.New("oci layout source requires a build context name")
+	}
+
+	id := "oci-layout://" + in.Context
+	if in.Digest != "" {
+		dgst, err := digest.Parse(in.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest for oci layout %s: %w", in.Context, err)
+		}
+		id += "@" + dgst.String()
+	}
+	return &pb.SourceOp{
+		Identifier: id,
+	}, nil
+}
+
+// Default secret names used for git authentication.
+// These match the defaults used by the Dockerfile frontend.
+const (
+	gitAuthTokenKey  = "GIT_AUTH_TOKEN"
+	gitAuthHeaderKey = "GIT_AUTH_HEADER"
+)
+
+// convertGitSource creates a git source. The identifier is constructed
+// from the host and path of the remote so the same repository accessed
+// over different protocols has the same identifier. The full remote
+// is passed as an attribute.
+func convertGitSource(in *dockerfile.GitSource) (*pb.SourceOp, error) {
+	remote, err := gitutil.ParseURL(in.Remote)
+	if errors.Is(err, gitutil.ErrUnknownProtocol) {
+		remote, err = gitutil.ParseURL("https://" + in.Remote)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid git remote %q: %w", in.Remote, err)
+	}
+
+	ref, subdir := in.Ref, in.Subdir
+	if remote.Opts != nil {
+		if ref == "" {
+			ref = remote.Opts.Ref
+		}
+		if subdir == "" {
+			subdir = remote.Opts.Subdir
+		}
+	}
+
+	attrs := map[string]string{
+		pb.AttrFullRemoteURL: remote.Remote,
+	}
+	if in.Commit != "" {
+		if ref == "" {
+			ref = in.Commit
+		} else {
+			attrs[pb.AttrGitChecksum] = in.Commit
+		}
+	}
+
+	id := remote.Host + path.Join("/", remote.Path)
+	if ref != "" || subdir != "" {
+		id += "#" + ref
+		if subdir != "" {
+			id += ":" + subdir
+		}
+	}
+
+	if in.KeepGitDir {
+		attrs[pb.AttrKeepGitDir] = "true"
+	}
+	if in.SkipSubmodules {
+		attrs[pb.AttrGitSkipSubmodules] = "true"
+	}
+
+	attrs[pb.AttrAuthTokenSecret] = cmp.Or(in.AuthTokenSecret, gitAuthTokenKey)
+	attrs[pb.AttrAuthHeaderSecret] = cmp.Or(in.AuthHeaderSecret, gitAuthHeaderKey)
+	if remote.Scheme == gitutil.SSHProtocol {
+		attrs[pb.AttrMountSSHSock] = "default"
+	}
+
+	return &pb.SourceOp{
+		Identifier: "git://" + id,
+		Attrs:      attrs,
 	}, nil
 }
 
-func convertExecOp(in *dockerfile.ExecOp) (*pb.Op, error) {
+// setPlatform sets the platform and worker constraints for the op.
+// An empty platform leaves the platform unset so buildkit uses the
+// default platform of the worker.
+func setPlatform(op *pb.Op, platform string, constraints []string) error {
+	if platform != "" {
+		p, err := platforms.Parse(platform)
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", platform, err)
+		}
+		p = platforms.Normalize(p)
+
+		op.Platform = &pb.Platform{
+			OS:           p.OS,
+			Architecture: p.Architecture,
+			Variant:      p.Variant,
+			OSVersion:    p.OSVersion,
+		}
+	}
+
+	if len(constraints) > 0 {
+		op.Constraints = &pb.WorkerConstraints{
+			Filter: constraints,
+		}
+	}
+	return nil
+}
+
+func convertExecOp(d string, in *dockerfile.ExecOp) (*pb.Op, error) {
 	exec := &pb.ExecOp{
 		Meta: &pb.Meta{
 			Args: in.Command,
 			Cwd:  in.Workdir,
 			Env:  in.Env,
+
+			User:           in.User,
+			Hostname:       in.Hostname,
+			CgroupParent:   in.CgroupParent,
+			ValidExitCodes: in.ValidExitCodes,
 		},
 	}
 
+	hosts := make([]string, 0, len(in.ExtraHosts))
+	for host := range in.ExtraHosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		ip := in.ExtraHosts[host]
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid ip address %q for extra host %q", ip, host)
+		}
+		exec.Meta.ExtraHosts = append(exec.Meta.ExtraHosts, &pb.HostIP{
+			Host: host,
+			IP:   ip,
+		})
+	}
+
+	names := make([]string, 0, len(in.Ulimits))
+	for name := range in.Ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !slices.Contains(ulimitNames, name) {
+			return nil, fmt.Errorf("invalid ulimit name %q", name)
+		}
+
+		// A limit of -1 is unlimited so it is never below the soft limit.
+		limit := in.Ulimits[name]
+		if limit.Hard != -1 && (limit.Soft == -1 || limit.Hard < limit.Soft) {
+			return nil, fmt.Errorf("ulimit %q: soft limit %d is greater than hard limit %d", name, limit.Soft, limit.Hard)
+		}
+		exec.Meta.Ulimit = append(exec.Meta.Ulimit, &pb.Ulimit{
+			Name: name,
+			Soft: limit.Soft,
+			Hard: limit.Hard,
+		})
+	}
+
 	out := &pb.Op{
 		Op: &pb.Op_Exec{
 			Exec: exec,
@@ -78,7 +389,7 @@ func convertExecOp(in *dockerfile.ExecOp) (*pb.Op, error) {
 			var err error
 			input, sel, err = resolveInput(out, spec.Input)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("mount %s: %w", path, err)
 			}
 		}
 
@@ -110,10 +421,139 @@ func convertExecOp(in *dockerfile.ExecOp) (*pb.Op, error) {
 		}
 		exec.Mounts = append(exec.Mounts, mount)
 	}
+
+	if in.Script != nil {
+		if err := addScript(d, out, in.Script); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := setPlatform(out, in.Platform, in.Constraints); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
-func convertFileOp(in *dockerfile.FileOp) (*pb.Op, error) {
+// defaultScriptPath is where a script is mounted when no path is given.
+// This matches where the Dockerfile frontend mounts heredocs.
+const defaultScriptPath = "/dev/pipes/script"
+
+// addScript attaches an inline script to the exec op. The script is either
+// passed directly to the interpreter as an argument or written to a file
+// that is mounted into the container and then run with the interpreter.
+// The command arguments of the exec op are passed to the script as the
+// positional parameters starting at $1 in both modes.
+func addScript(d string, op *pb.Op, script *dockerfile.ScriptSpec) error {
+	exec := op.GetExec()
+
+	path := script.Path
+	if path == "" {
+		path = defaultScriptPath
+	}
+
+	if script.Inline {
+		if len(script.Interpreter) == 0 {
+			return errors.New("inline script requires an interpreter")
+		}
+
+		// The argument after the script text is $0 so the script
+		// path is used as a placeholder like the file mode.
+		args := slices.Clone(script.Interpreter)
+		args = append(args, "-c", script.Text, path)
+		exec.Meta.Args = append(args, exec.Meta.Args...)
+		return nil
+	}
+
+	mode, err := parseMode(script.Mode, 0o755)
+	if err != nil {
+		return err
+	}
+
+	fpath, err := writeVertex(d, "script", "script "+path, &pb.Op{
+		Op: &pb.Op_File{
+			File: &pb.FileOp{
+				Actions: []*pb.FileAction{
+					{
+						Input:          -1,
+						SecondaryInput: -1,
+						Output:         0,
+						Action: &pb.FileAction_Mkfile{
+							Mkfile: &pb.FileActionMkFile{
+								Path: "/script",
+								Data: []byte(script.Text),
+								Mode: mode,
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	op.Inputs = append(op.Inputs, &pb.Input{
+		Digest: fpath,
+	})
+	exec.Mounts = append(exec.Mounts, &pb.Mount{
+		Input:    int64(len(op.Inputs) - 1),
+		Selector: "/script",
+		Dest:     path,
+		Output:   -1,
+		Readonly: true,
+	})
+
+	args := slices.Clone(script.Interpreter)
+	args = append(args, path)
+	exec.Meta.Args = append(args, exec.Meta.Args...)
+	return nil
+}
+
+// writeVertex writes an additional vertex used as an input by
+// the op to a subdirectory of the output directory. The default name
+// is shown in the progress output for the vertex.
+func writeVertex(d, dir, defaultName string, op *pb.Op) (string, error) {
+	fpath := filepath.Join(d, dir)
+	if err := os.Mkdir(fpath, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	v := &dockerfile.Vertex{
+		Op: op,
+		Meta: &dockerfile.Metadata{
+			Description: map[string]string{
+				dockerfile.DefaultNameKey: shorten(defaultName),
+			},
+		},
+	}
+	if err := WriteJSON(v, fpath, "vertex.json"); err != nil {
+		return "", err
+	}
+	return filepath.Join(fpath, "vertex.json"), nil
+}
+
+// parseMode parses an octal file mode. The default is used
+// when the mode is empty.
+func parseMode(s string, def int32) (int32, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	mode, err := strconv.ParseInt(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: %w", s, err)
+	}
+	return int32(mode), nil
+}
+
+// ulimitNames are the resource limit names accepted by buildkit.
+var ulimitNames = []string{
+	"core", "cpu", "data", "fsize", "locks", "memlock", "msgqueue", "nice",
+	"nofile", "nproc", "rss", "rtprio", "rttime", "sigpending", "stack",
+}
+
+func convertFileOp(d string, in *dockerfile.FileOp) (*pb.Op, error) {
 	op := &pb.Op{}
 
 	inp := MergeInput{
@@ -123,7 +563,7 @@ func convertFileOp(in *dockerfile.FileOp) (*pb.Op, error) {
 		var err error
 		inp.Index, inp.Path, err = resolveInput(op, in.Target)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("target: %w", err)
 		}
 	}
 
@@ -133,17 +573,40 @@ func convertFileOp(in *dockerfile.FileOp) (*pb.Op, error) {
 	}
 	sort.Strings(paths)
 
-	sources := make(map[string]*MergeInput)
+	var (
+		sources   = make(map[string]*MergeInput)
+		checksums = make(map[string]string)
+	)
 	for _, p := range paths {
-		if entry := in.Locations[p]; entry.Source != "" {
+		switch entry := in.Locations[p]; {
+		case entry.Source != "":
 			index, path, err := resolveInput(op, entry.Source)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("source for %s: %w", p, err)
 			}
 			sources[entry.Source] = &MergeInput{
 				Index: index,
 				Path:  path,
 			}
+		case entry.URL != "":
+			// Each url is downloaded once so every entry that uses
+			// it must expect the same contents.
+			if checksum, ok := checksums[entry.URL]; ok {
+				if checksum != entry.Checksum {
+					return nil, fmt.Errorf("conflicting checksums for %s: %s and %s", entry.URL, checksum, entry.Checksum)
+				}
+				continue
+			}
+
+			index, path, err := addURLSource(d, op, entry, len(sources))
+			if err != nil {
+				return nil, fmt.Errorf("invalid url for %s: %w", p, err)
+			}
+			sources[entry.URL] = &MergeInput{
+				Index: index,
+				Path:  path,
+			}
+			checksums[entry.URL] = entry.Checksum
 		}
 	}
 
@@ -173,22 +636,84 @@ func convertFileOp(in *dockerfile.FileOp) (*pb.Op, error) {
 			Output:         -1,
 		}
 
-		switch entry := in.Locations[p]; {
-		case entry.Source != "":
-			inp := sources[entry.Source]
+		entry := in.Locations[p]
+		owner, err := parseChown(entry.Chown, inp.Index)
+		if err != nil {
+			return nil, fmt.Errorf("invalid owner for %s: %w", p, err)
+		}
+
+		timestamp, err := parseTimestamp(entry.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp for %s: %w", p, err)
+		}
+
+		switch {
+		case entry.Source != "" || entry.URL != "":
+			mode, err := parseMode(entry.Mode, -1)
+			if err != nil {
+				return nil, err
+			}
+
+			src := entry.Source
+			if src == "" {
+				src = entry.URL
+			}
+
+			inp := sources[src]
 			action.SecondaryInput = int64(inp.Index)
-			action.Action = &pb.FileAction_Copy{
-				Copy: &pb.FileActionCopy{
-					Src:  inp.Path,
-					Dest: p,
-				},
+
+			cp := &pb.FileActionCopy{
+				Src:       inp.Path,
+				Dest:      p,
+				Mode:      mode,
+				Owner:     owner,
+				Timestamp: timestamp,
 			}
+			setCopyOptions(cp, &entry.CopyOptions)
+			action.Action = &pb.FileAction_Copy{Copy: cp}
 		case entry.Text != "":
+			mode, err := parseMode(entry.Mode, 0o644)
+			if err != nil {
+				return nil, err
+			}
 			action.Action = &pb.FileAction_Mkfile{
 				Mkfile: &pb.FileActionMkFile{
-					Path: p,
-					Data: []byte(entry.Text),
-					Mode: 0644,
+					Path:      p,
+					Data:      []byte(entry.Text),
+					Mode:      mode,
+					Owner:     owner,
+					Timestamp: timestamp,
+				},
+			}
+		case entry.Directory:
+			mode, err := parseMode(entry.Mode, 0o755)
+			if err != nil {
+				return nil, err
+			}
+			action.Action = &pb.FileAction_Mkdir{
+				Mkdir: &pb.FileActionMkDir{
+					Path:        p,
+					Mode:        mode,
+					MakeParents: true,
+					Owner:       owner,
+					Timestamp:   timestamp,
+				},
+			}
+		case entry.Remove:
+			action.Action = &pb.FileAction_Rm{
+				Rm: &pb.FileActionRm{
+					Path:          p,
+					AllowNotFound: true,
+					AllowWildcard: true,
+				},
+			}
+		case entry.Symlink != "":
+			action.Action = &pb.FileAction_Symlink{
+				Symlink: &pb.FileActionSymlink{
+					Oldpath:   entry.Symlink,
+					Newpath:   p,
+					Owner:     owner,
+					Timestamp: timestamp,
 				},
 			}
 		}
@@ -207,12 +732,128 @@ func convertFileOp(in *dockerfile.FileOp) (*pb.Op, error) {
 	return op, nil
 }
 
+// parseChown parses an owner in the form user[:group]. The user and group
+// may either be a name or a numeric id. Names are looked up in the
+// filesystem of the base input.
+func parseChown(s string, base pb.InputIndex) (*pb.ChownOpt, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	userName, groupName, _ := strings.Cut(s, ":")
+	user, err := parseUser(userName, base)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := &pb.ChownOpt{User: user}
+	if groupName != "" {
+		if owner.Group, err = parseUser(groupName, base); err != nil {
+			return nil, err
+		}
+	}
+	return owner, nil
+}
+
+func parseUser(name string, base pb.InputIndex) (*pb.UserOpt, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return &pb.UserOpt{
+			User: &pb.UserOpt_ByID{ByID: uint32(id)},
+		}, nil
+	}
+
+	if base < 0 {
+		return nil, fmt.Errorf("cannot look up %q without a target", name)
+	}
+	return &pb.UserOpt{
+		User: &pb.UserOpt_ByName{
+			ByName: &pb.NamedUserOpt{
+				Name:  name,
+				Input: int64(base),
+			},
+		},
+	}, nil
+}
+
+// parseTimestamp parses a timestamp as either seconds since the
+// unix epoch or an RFC 3339 date. An empty timestamp is unset and
+// returns -1 so buildkit keeps the default modification time.
+func parseTimestamp(s string) (int64, error) {
+	if s == "" {
+		return -1, nil
+	}
+
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0).UnixNano(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+// addURLSource adds an http source for the url as an input to the op.
+// The checksum is required so the download is reproducible.
+func addURLSource(d string, op *pb.Op, entry *dockerfile.FSEntry, n int) (pb.InputIndex, string, error) {
+	if entry.Checksum == "" {
+		return -1, "", fmt.Errorf("a checksum is required for %s", entry.URL)
+	}
+
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return -1, "", err
+	}
+
+	filename := path.Base(u.Path)
+	if filename == "/" || filename == "." {
+		filename = "index"
+	}
+
+	source, err := convertHTTPSource(&dockerfile.HTTPSource{
+		URL:      entry.URL,
+		Checksum: entry.Checksum,
+		Filename: filename,
+	})
+	if err != nil {
+		return -1, "", err
+	}
+
+	fpath, err := writeVertex(d, fmt.Sprintf("url-%d", n), "download "+entry.URL, &pb.Op{
+		Op: &pb.Op_Source{
+			Source: source,
+		},
+	})
+	if err != nil {
+		return -1, "", err
+	}
+
+	op.Inputs = append(op.Inputs, &pb.Input{
+		Digest: fpath,
+	})
+	return pb.InputIndex(len(op.Inputs) - 1), "/" + filename, nil
+}
+
+// setCopyOptions applies the copy options to the copy action.
+func setCopyOptions(cp *pb.FileActionCopy, opts *dockerfile.CopyOptions) {
+	cp.IncludePatterns = opts.Include
+	cp.ExcludePatterns = opts.Exclude
+	cp.FollowSymlink = opts.FollowSymlinks
+	cp.AllowWildcard = opts.AllowWildcard
+	cp.CreateDestPath = opts.CreateDestPath
+	cp.DirCopyContents = opts.CopyDirContentsOnly
+	cp.AlwaysReplaceExistingDestPaths = opts.AlwaysReplaceExistingDestPaths
+	cp.AttemptUnpackDockerCompatibility = opts.Unpack
+}
+
 type MergeInput struct {
-	Index pb.InputIndex
-	Path  string
+	Index   pb.InputIndex
+	Path    string
+	Options *dockerfile.CopyOptions
 }
 
-func convertMergeOp(in *dockerfile.MergeOp) (*pb.Op, error) {
+func convertMergeOp(d string, in *dockerfile.MergeOp) (*pb.Op, error) {
 	op := &pb.Op{}
 
 	var (
@@ -225,7 +866,7 @@ func convertMergeOp(in *dockerfile.MergeOp) (*pb.Op, error) {
 		var err error
 		target.Index, target.Path, err = resolveInput(op, in.Target)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("target: %w", err)
 		}
 	}
 
@@ -233,75 +874,96 @@ func convertMergeOp(in *dockerfile.MergeOp) (*pb.Op, error) {
 		target.Path = "/"
 	}
 
-	for _, input := range in.Inputs {
-		index, path, err := resolveInput(op, input)
+	for i, input := range in.Inputs {
+		// Resolve the input separately so it is only added to the
+		// op when it is used directly by the merge.
+		resolved := &pb.Op{}
+		index, path, err := resolveInput(resolved, input.Source)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("merge input %d: %w", i, err)
 		}
-		inputs = append(inputs, &MergeInput{
-			Index: index,
-			Path:  path,
-		})
-	}
 
-	if len(inputs) == 0 {
-		return op, nil
-	} else if canMerge(target, inputs) {
-		return mkMerge(op, target.Index, inputs)
-	}
-
-	file := &pb.FileOp{}
-	offset := len(op.Inputs)
-	for i, input := range inputs {
-		src := input.Path
-		if src == "" {
-			src = "/"
+		if path == "" {
+			path = "/"
 		}
 
-		action := &pb.FileAction{
-			Input:          int64(target.Index),
-			SecondaryInput: int64(input.Index),
-			Output:         -1,
-			Action: &pb.FileAction_Copy{
-				Copy: &pb.FileActionCopy{
-					Src:  src,
-					Dest: target.Path,
-					Mode: -1,
-				},
-			},
+		inp := &MergeInput{
+			Index:   index,
+			Path:    path,
+			Options: &input.CopyOptions,
 		}
-		if i == len(inputs)-1 {
-			action.Output = 0
+		dgst := resolved.Inputs[index].Digest
+		if canMerge(target, inp) {
+			inp.Index = addInput(op, dgst)
+		} else {
+			if inp.Index, err = rebaseInput(d, op, i, dgst, target.Path, inp); err != nil {
+				return nil, err
+			}
+			inp.Path = "/"
 		}
-		target.Index = pb.InputIndex(len(file.Actions) + offset)
+		inputs = append(inputs, inp)
+	}
 
-		file.Actions = append(file.Actions, action)
+	if len(inputs) == 0 {
+		return op, nil
 	}
+	return mkMerge(op, target.Index, inputs)
+}
 
-	op.Op = &pb.Op_File{File: file}
-	return op, nil
+// canMerge reports whether the input can be used as a merge input
+// without modification. The input must be the root of its filesystem
+// and it must be merged into the root of the target.
+func canMerge(target MergeInput, input *MergeInput) bool {
+	return target.Path == "/" && input.Path == "/" && input.Options.IsZero()
 }
 
-func canMerge(target MergeInput, inputs []*MergeInput) bool {
-	if target.Index < 0 || target.Path != "" {
-		return false
+// rebaseInput copies the input into the destination directory on top of
+// scratch and adds the result as an input to the op. The copy only contains
+// the files from the input so merging it keeps the layers of the target
+// shared and unchanged.
+func rebaseInput(d string, op *pb.Op, n int, dgst, dest string, input *MergeInput) (pb.InputIndex, error) {
+	cp := &pb.FileActionCopy{
+		Src:  input.Path,
+		Dest: dest,
+		Mode: -1,
 	}
+	setCopyOptions(cp, input.Options)
+	cp.CreateDestPath = true
 
-	for _, input := range inputs {
-		if input.Path != "" {
-			return false
-		}
+	fpath, err := writeVertex(d, fmt.Sprintf("rebase-%d", n), fmt.Sprintf("copy %s -> %s", input.Path, dest), &pb.Op{
+		Inputs: []*pb.Input{
+			{Digest: dgst},
+		},
+		Op: &pb.Op_File{
+			File: &pb.FileOp{
+				Actions: []*pb.FileAction{
+					{
+						Input:          -1,
+						SecondaryInput: 0,
+						Output:         0,
+						Action: &pb.FileAction_Copy{
+							Copy: cp,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return -1, err
 	}
-	return true
+	return addInput(op, fpath), nil
 }
 
 func mkMerge(op *pb.Op, target pb.InputIndex, inputs []*MergeInput) (*pb.Op, error) {
 	merge := &pb.MergeOp{
 		Inputs: make([]*pb.MergeInput, 0, len(inputs)+1),
 	}
-	merge.Inputs = append(merge.Inputs, &pb.MergeInput{
-		Input: int64(target),
-	})
+	if target >= 0 {
+		merge.Inputs = append(merge.Inputs, &pb.MergeInput{
+			Input: int64(target),
+		})
+	}
 	for _, input := range inputs {
 		merge.Inputs = append(merge.Inputs, &pb.MergeInput{
 			Input: int64(input.Index),
@@ -312,6 +974,47 @@ func mkMerge(op *pb.Op, target pb.InputIndex, inputs []*MergeInput) (*pb.Op, err
 	return op, nil
 }
 
+func convertDiffOp(in *dockerfile.DiffOp) (*pb.Op, error) {
+	op := &pb.Op{}
+
+	lower, err := resolveDiffInput(op, in.Lower)
+	if err != nil {
+		return nil, fmt.Errorf("lower: %w", err)
+	}
+
+	upper, err := resolveDiffInput(op, in.Upper)
+	if err != nil {
+		return nil, fmt.Errorf("upper: %w", err)
+	}
+
+	op.Op = &pb.Op_Diff{
+		Diff: &pb.DiffOp{
+			Lower: &pb.LowerDiffInput{Input: int64(lower)},
+			Upper: &pb.UpperDiffInput{Input: int64(upper)},
+		},
+	}
+	return op, nil
+}
+
+// resolveDiffInput resolves an input for a diff. An empty input
+// is scratch. A diff can only be computed between whole filesystems
+// so the input cannot refer to a subdirectory.
+func resolveDiffInput(op *pb.Op, input string) (pb.InputIndex, error) {
+	if input == "" {
+		return -1, nil
+	}
+
+	index, path, err := resolveInput(op, input)
+	if err != nil {
+		return -1, err
+	}
+
+	if path != "" && path != "/" {
+		return -1, fmt.Errorf("cannot diff subdirectory %q of %s", path, input)
+	}
+	return index, nil
+}
+
 func resolvePath(fpath string) (inputPath, mountPath string, err error) {
 	for inputPath = fpath; inputPath != "/"; {
 		if _, err := os.Stat(filepath.Join(inputPath, "index.json")); err == nil {
@@ -327,7 +1030,7 @@ func resolvePath(fpath string) (inputPath, mountPath string, err error) {
 		inputPath, prefix = splitPath(inputPath)
 		mountPath = "/" + prefix + mountPath
 	}
-	return "", "", errors.New("index.json not found")
+	return "", "", fmt.Errorf("%s is not the output of an llb operation: no index.json found in any parent directory", fpath)
 }
 
 func resolveInput(op *pb.Op, fpath string) (pb.InputIndex, string, error) {
@@ -362,16 +1065,22 @@ func resolveInput(op *pb.Op, fpath string) (pb.InputIndex, string, error) {
 		mountPath = strings.TrimPrefix(mountPath, sel)
 	}
 
+	return addInput(op, inputPath), mountPath, nil
+}
+
+// addInput adds the vertex as an input to the op if it is not
+// already an input and returns the index of the input.
+func addInput(op *pb.Op, fpath string) pb.InputIndex {
 	i := slices.IndexFunc(op.Inputs, func(inp *pb.Input) bool {
-		return inp.Digest == inputPath
+		return inp.Digest == fpath
 	})
 	if i < 0 {
 		i = len(op.Inputs)
 		op.Inputs = append(op.Inputs, &pb.Input{
-			Digest: inputPath,
+			Digest: fpath,
 		})
 	}
-	return pb.InputIndex(i), mountPath, nil
+	return pb.InputIndex(i)
 }
 
 func splitPath(s string) (dir, file string) {
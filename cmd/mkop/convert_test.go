@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jsternberg/nix-frontend/dockerfile"
+)
+
+// writeOutput creates the output of an op with the index that maps
+// its root to the vertex and returns the directory of the output.
+func writeOutput(t *testing.T, dir string) string {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	vertex := filepath.Join(dir, "vertex.json")
+	if err := WriteJSON(map[string]string{"/": vertex}, dir, "index.json"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readVertex(t *testing.T, fpath string) *dockerfile.Vertex {
+	t.Helper()
+
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &dockerfile.Vertex{}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestConvertMergeOp(t *testing.T) {
+	dir := t.TempDir()
+	base := writeOutput(t, filepath.Join(dir, "base"))
+	input := writeOutput(t, filepath.Join(dir, "input"))
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		source string
+		// rebase is the source and destination of the copy when the
+		// input has to be rebased before it is merged.
+		rebase *[2]string
+	}{
+		{
+			name:   "Root",
+			target: base,
+			source: input,
+		},
+		{
+			name:   "TargetSubdirectory",
+			target: filepath.Join(base, "sub"),
+			source: input,
+			rebase: &[2]string{"/", "/sub"},
+		},
+		{
+			name:   "InputSubdirectory",
+			target: base,
+			source: filepath.Join(input, "sub"),
+			rebase: &[2]string{"/sub", "/"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := t.TempDir()
+			op, err := convertMergeOp(d, &dockerfile.MergeOp{
+				Target: tt.target,
+				Inputs: []*dockerfile.MergeSource{
+					{Source: tt.source},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(op.Inputs) != 2 {
+				t.Fatalf("expected 2 inputs, got %d", len(op.Inputs))
+			}
+			if got, want := op.Inputs[0].Digest, filepath.Join(base, "vertex.json"); got != want {
+				t.Errorf("expected target %s, got %s", want, got)
+			}
+
+			merge := op.GetMerge()
+			if merge == nil || len(merge.Inputs) != 2 ||
+				merge.Inputs[0].Input != 0 || merge.Inputs[1].Input != 1 {
+				t.Fatalf("expected a merge of inputs 0 and 1, got %v", op.Op)
+			}
+
+			rebased := filepath.Join(d, "rebase-0", "vertex.json")
+			if tt.rebase == nil {
+				if got, want := op.Inputs[1].Digest, filepath.Join(input, "vertex.json"); got != want {
+					t.Errorf("expected input %s, got %s", want, got)
+				}
+				if _, err := os.Stat(rebased); !os.IsNotExist(err) {
+					t.Errorf("expected no rebased input, got %v", err)
+				}
+				return
+			}
+
+			if got := op.Inputs[1].Digest; got != rebased {
+				t.Fatalf("expected rebased input %s, got %s", rebased, got)
+			}
+
+			v := readVertex(t, rebased)
+			if v.Meta == nil {
+				t.Fatal("expected the rebased input to have metadata")
+			}
+			if got, want := v.Meta.Description[dockerfile.DefaultNameKey], "copy "+tt.rebase[0]+" -> "+tt.rebase[1]; got != want {
+				t.Errorf("expected default name %q, got %q", want, got)
+			}
+			if len(v.Op.Inputs) != 1 || v.Op.Inputs[0].Digest != filepath.Join(input, "vertex.json") {
+				t.Errorf("expected the rebase to copy from the input, got %v", v.Op.Inputs)
+			}
+
+			actions := v.Op.GetFile().GetActions()
+			if len(actions) != 1 {
+				t.Fatalf("expected a single copy action, got %d actions", len(actions))
+			}
+
+			action := actions[0]
+			cp := action.GetCopy()
+			if action.Input != -1 || action.SecondaryInput != 0 || cp == nil {
+				t.Fatalf("expected a copy from input 0 onto scratch, got %v", action)
+			}
+			if cp.Src != tt.rebase[0] || cp.Dest != tt.rebase[1] {
+				t.Errorf("expected a copy from %s to %s, got a copy from %s to %s",
+					tt.rebase[0], tt.rebase[1], cp.Src, cp.Dest)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+	}{
+		{in: "", want: -1},
+		{in: "0", want: 0},
+		{in: "1700000000", want: 1700000000 * int64(time.Second)},
+		{in: "2023-11-14T22:13:20Z", want: 1700000000 * int64(time.Second)},
+	} {
+		got, err := parseTimestamp(tt.in)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("parse %q: expected %d, got %d", tt.in, tt.want, got)
+		}
+	}
+
+	if _, err := parseTimestamp("yesterday"); err == nil {
+		t.Error("expected an error for an invalid timestamp")
+	}
+}
+
+func TestConvertFileOpURLChecksums(t *testing.T) {
+	const (
+		url   = "https://example.com/archive.tar.gz"
+		sumA  = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+		sumB  = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		destA = "/a"
+		destB = "/b"
+	)
+
+	op, err := convertFileOp(t.TempDir(), &dockerfile.FileOp{
+		Locations: map[string]*dockerfile.FSEntry{
+			destA: {URL: url, Checksum: sumA},
+			destB: {URL: url, Checksum: sumA},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(op.Inputs) != 1 {
+		t.Errorf("expected the url to be downloaded once, got %d inputs", len(op.Inputs))
+	}
+
+	if _, err := convertFileOp(t.TempDir(), &dockerfile.FileOp{
+		Locations: map[string]*dockerfile.FSEntry{
+			destA: {URL: url, Checksum: sumA},
+			destB: {URL: url, Checksum: sumB},
+		},
+	}); err == nil {
+		t.Error("expected an error for conflicting checksums")
+	}
+}
+
+func TestConvertExecOpUlimits(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		limit dockerfile.UlimitSpec
+		valid bool
+	}{
+		{name: "Equal", limit: dockerfile.UlimitSpec{Soft: 1024, Hard: 1024}, valid: true},
+		{name: "UnlimitedHard", limit: dockerfile.UlimitSpec{Soft: 1024, Hard: -1}, valid: true},
+		{name: "Unlimited", limit: dockerfile.UlimitSpec{Soft: -1, Hard: -1}, valid: true},
+		{name: "SoftAboveHard", limit: dockerfile.UlimitSpec{Soft: 2048, Hard: 1024}},
+		{name: "UnlimitedSoft", limit: dockerfile.UlimitSpec{Soft: -1, Hard: 1024}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := convertExecOp(t.TempDir(), &dockerfile.ExecOp{
+				Command: []string{"true"},
+				Ulimits: map[string]*dockerfile.UlimitSpec{
+					"nofile": &tt.limit,
+				},
+			})
+			if tt.valid && err != nil {
+				t.Fatal(err)
+			} else if !tt.valid && err == nil {
+				t.Fatal("expected an error for the ulimit")
+			}
+		})
+	}
+}
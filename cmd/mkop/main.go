@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/jsternberg/nix-frontend/dockerfile"
 	"github.com/moby/buildkit/solver/pb"
@@ -27,17 +29,22 @@ func mkop(d string, infile string) error {
 			return err
 		}
 	case spec.Exec != nil:
-		op, err = convertExecOp(spec.Exec)
+		op, err = convertExecOp(d, spec.Exec)
 		if err != nil {
 			return err
 		}
 	case spec.File != nil:
-		op, err = convertFileOp(spec.File)
+		op, err = convertFileOp(d, spec.File)
 		if err != nil {
 			return err
 		}
 	case spec.Merge != nil:
-		op, err = convertMergeOp(spec.Merge)
+		op, err = convertMergeOp(d, spec.Merge)
+		if err != nil {
+			return err
+		}
+	case spec.Diff != nil:
+		op, err = convertDiffOp(spec.Diff)
 		if err != nil {
 			return err
 		}
@@ -55,6 +62,22 @@ func mkop(d string, infile string) error {
 			v.Meta = &dockerfile.Metadata{}
 		}
 		v.Meta.Description = spec.Meta.Description
+		v.Meta.Locations = spec.Meta.Locations
+		v.Meta.ProgressGroup = spec.Meta.ProgressGroup
+	}
+
+	if name := defaultName(spec, op); name != "" {
+		if v.Meta == nil {
+			v.Meta = &dockerfile.Metadata{}
+		}
+		if v.Meta.Description == nil {
+			v.Meta.Description = map[string]string{}
+		}
+
+		// The default name is kept separate from the custom name so
+		// marshal can combine it when ops are fused. It is only used
+		// when a custom name has not been given.
+		v.Meta.Description[dockerfile.DefaultNameKey] = name
 	}
 
 	if err := WriteJSON(v, d, "vertex.json"); err != nil {
@@ -100,6 +123,69 @@ func mkop(d string, infile string) error {
 	return nil
 }
 
+// defaultName returns the name shown in the progress output for the op.
+func defaultName(spec *dockerfile.OpSpec, op *pb.Op) string {
+	switch o := op.Op.(type) {
+	case *pb.Op_Source:
+		// Nix exposes the derivation name to the builder.
+		if name := os.Getenv("name"); name != "" {
+			return strings.TrimPrefix(name, "llb-")
+		}
+		return o.Source.Identifier
+	case *pb.Op_Exec:
+		if spec.Exec.Script != nil {
+			return shorten(spec.Exec.Script.Text)
+		}
+
+		args := o.Exec.Meta.Args
+		if len(args) == 3 && args[1] == "-c" {
+			// Show the shell command without the shell.
+			args = args[2:]
+		}
+		return shorten(strings.Join(args, " "))
+	case *pb.Op_File:
+		names := make([]string, 0, len(o.File.Actions))
+		for _, action := range o.File.Actions {
+			names = append(names, describeFileAction(action))
+		}
+		return strings.Join(names, ", ")
+	case *pb.Op_Merge:
+		return dockerfile.MergeName(len(o.Merge.Inputs))
+	case *pb.Op_Diff:
+		return "diff"
+	}
+	return ""
+}
+
+func describeFileAction(action *pb.FileAction) string {
+	switch a := action.Action.(type) {
+	case *pb.FileAction_Copy:
+		return fmt.Sprintf("copy %s -> %s", path.Clean("/"+a.Copy.Src), a.Copy.Dest)
+	case *pb.FileAction_Mkfile:
+		return "mkfile " + a.Mkfile.Path
+	case *pb.FileAction_Mkdir:
+		return "mkdir " + a.Mkdir.Path
+	case *pb.FileAction_Rm:
+		return "rm " + a.Rm.Path
+	case *pb.FileAction_Symlink:
+		return fmt.Sprintf("symlink %s -> %s", a.Symlink.Newpath, a.Symlink.Oldpath)
+	}
+	return ""
+}
+
+// maxNameLength is the length after which default names are truncated.
+const maxNameLength = 72
+
+// shorten collapses the whitespace in s to a single line and truncates
+// it so it fits in the progress output.
+func shorten(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > maxNameLength {
+		s = string(r[:maxNameLength-3]) + "..."
+	}
+	return s
+}
+
 func WriteJSON(v any, paths ...string) error {
 	data, err := json.MarshalIndent(v, "", "\t")
 	if err != nil {
@@ -130,7 +216,15 @@ func main() {
 				return err
 			}
 		}
-		return mkop(outdir, infile)
+		if err := mkop(outdir, infile); err != nil {
+			// Nix exposes the derivation name to the builder so errors
+			// point at the library function that produced the spec.
+			if name := os.Getenv("name"); name != "" {
+				return fmt.Errorf("derivation %s: %w", name, err)
+			}
+			return err
+		}
+		return nil
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -1,28 +1,42 @@
 package dockerfile
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
 
+	"github.com/containerd/platforms"
 	"github.com/distribution/reference"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/client/llb/sourceresolver"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
 	"github.com/moby/buildkit/solver/pb"
 	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	"github.com/moby/patternmatcher/ignorefile"
 	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
 const PATH = "/nix/var/nix/profiles/per-user/root/profile/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 
+// nixFile is the path where dockerfile.nix is mounted for evaluation.
+const nixFile = "/src/dockerfile.nix"
+
+// specVersionExitCode is the exit code of nix-solve when a library
+// requires a newer spec version than this frontend supports.
+const specVersionExitCode = 3
+
 func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 	var frontendImg llb.State
 	if cc, ok := c.(cf); ok {
@@ -45,14 +59,32 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 		target = strings.TrimPrefix(target, "debug:")
 	}
 
+	// A target may have companion outputs which are selected
+	// with target/output.
+	target, output, ok := strings.Cut(target, "/")
+	if !ok {
+		output = "default"
+	}
+
 	runArgs := []string{
 		"nix-solve",
-		"-f", "/src/dockerfile.nix",
+		"-f", nixFile,
 		"-t", target,
 		"-o", "/result/dockerfile.json",
 	}
 
 	buildArgs := getBuildArgs(c)
+
+	platformArgs, err := getPlatformArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range platformArgs {
+		if _, ok := buildArgs[k]; !ok {
+			buildArgs[k] = v
+		}
+	}
+
 	if len(buildArgs) > 0 {
 		runArgs = append(runArgs, "-a", "/inputs/args.json")
 	}
@@ -99,6 +131,10 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 	}
 	res, err := c.Solve(ctx, req)
 	if err != nil {
+		var exitErr *gatewaypb.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode == specVersionExitCode {
+			return nil, fmt.Errorf("library requires a newer frontend, this frontend supports spec version %d: update the frontend: %w", SpecVersion, err)
+		}
 		return nil, err
 	}
 
@@ -114,8 +150,8 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 		return nil, err
 	}
 
-	outDef := &pb.Definition{}
-	if err := protojson.Unmarshal(in, outDef); err != nil {
+	outDef, err := readDefinition(in)
+	if err != nil {
 		return nil, err
 	}
 
@@ -124,6 +160,44 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 		return nil, err
 	}
 
+	if err := gr.Select(output); err != nil {
+		return nil, err
+	}
+
+	if _, op := gr.Head(); len(op.Inputs) == 0 {
+		// The output is scratch so there is nothing to solve.
+		// A check of scratch always succeeds.
+		if check := gr.Check(); check != "" {
+			return checkResult(check), nil
+		}
+		res := client.NewResult()
+		res.SetRef(nil)
+		return res, nil
+	}
+
+	if proxyEnv := getProxyEnv(c); proxyEnv != nil {
+		if err := gr.Walk(func(op *pb.Op) error {
+			if exec := op.GetExec(); exec != nil {
+				exec.Meta.ProxyEnv = proxyEnv.CloneVT()
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := resolveOCILayouts(c, gr); err != nil {
+		return nil, err
+	}
+
+	if err := applyDockerignore(ctx, c, gr); err != nil {
+		return nil, err
+	}
+
+	if err := loadNixSource(ctx, c, gr); err != nil {
+		return nil, err
+	}
+
 	img, err := resolveImages(ctx, c, gr)
 	if err != nil {
 		return nil, err
@@ -138,6 +212,10 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 		return buildDebugOutput(ctx, c, outDef)
 	}
 
+	if check := gr.Check(); check != "" {
+		return solveCheck(ctx, c, check, outDef)
+	}
+
 	res, err = c.Solve(ctx, client.SolveRequest{
 		Definition: outDef,
 	})
@@ -155,6 +233,47 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 	return res, nil
 }
 
+// readDefinition decodes the definition written by marshal. The version
+// that marshal writes next to the definition is not part of it and is
+// removed before decoding.
+func readDefinition(in []byte) (*pb.Definition, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(in, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "version")
+
+	in, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	def := &pb.Definition{}
+	if err := protojson.Unmarshal(in, def); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func solveCheck(ctx context.Context, c client.Client, name string, def *pb.Definition) (*client.Result, error) {
+	if _, err := c.Solve(ctx, client.SolveRequest{
+		Definition: def,
+		Evaluate:   true,
+	}); err != nil {
+		return nil, fmt.Errorf("check %q failed: %w", name, err)
+	}
+	return checkResult(name), nil
+}
+
+// checkResult returns the result of a successful check.
+func checkResult(name string) *client.Result {
+	res := client.NewResult()
+	res.SetRef(nil)
+	res.AddMeta(CheckKey+".name", []byte(name))
+	res.AddMeta(CheckKey+".status", []byte("success"))
+	return res
+}
+
 type Image struct {
 	Ref    string
 	Digest digest.Digest
@@ -170,14 +289,14 @@ func resolveImages(ctx context.Context, c client.Client, gr *graph) (*dockerspec
 	for dgst, op := range gr.All() {
 		switch o := op.Op.(type) {
 		case *pb.Op_Source:
-			if !strings.HasPrefix(o.Source.Identifier, "docker-image://") {
-				continue
+			switch scheme, ref, _ := strings.Cut(o.Source.Identifier, "://"); scheme {
+			case "docker-image":
+				config := imgs[imageKey(ref, op.Platform)]
+				o.Source.Identifier = "docker-image://" + config.Ref
+				imgs[string(dgst)] = config
+			case "oci-layout":
+				imgs[string(dgst)] = imgs[imageKey(o.Source.Identifier, op.Platform)]
 			}
-
-			ref := strings.TrimPrefix(o.Source.Identifier, "docker-image://")
-			config := imgs[ref]
-			o.Source.Identifier = "docker-image://" + config.Ref
-			imgs[string(dgst)] = config
 		case *pb.Op_Exec:
 			for _, m := range o.Exec.Mounts {
 				if m.Dest == "/" && m.Input >= 0 {
@@ -196,6 +315,13 @@ func resolveImages(ctx context.Context, c client.Client, gr *graph) (*dockerspec
 					}
 				}
 			}
+		case *pb.Op_Diff:
+			// The diff contains the changes made by the upper
+			// input so inherit the image config from it.
+			if o.Diff.Upper.Input >= 0 {
+				inp := op.Inputs[o.Diff.Upper.Input]
+				imgs[string(dgst)] = imgs[inp.Digest]
+			}
 		default:
 			if len(op.Inputs) > 0 {
 				inp := op.Inputs[0]
@@ -211,6 +337,210 @@ func resolveImages(ctx context.Context, c client.Client, gr *graph) (*dockerspec
 	return nil, nil
 }
 
+// loadNixSource includes the contents of dockerfile.nix in the source
+// map so errors are shown with the code that defined the failing op.
+// It is only mounted during the evaluation so marshal cannot read it.
+func loadNixSource(ctx context.Context, c client.Client, gr *graph) error {
+	for _, info := range gr.SourceInfos() {
+		if info.Filename != nixFile {
+			continue
+		}
+
+		dt, err := readLocalFile(ctx, c, "dockerfile", "dockerfile.nix")
+		if err != nil {
+			return err
+		}
+		info.Filename = "dockerfile.nix"
+		info.Data = dt
+	}
+	return nil
+}
+
+// applyDockerignore excludes the patterns in the dockerignore file
+// from every local source that reads the build context.
+func applyDockerignore(ctx context.Context, c client.Client, gr *graph) error {
+	var sources []*pb.SourceOp
+	for _, op := range gr.All() {
+		if src := op.GetSource(); src != nil && src.Identifier == "local://context" {
+			sources = append(sources, src)
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	excludes, err := readDockerignore(ctx, c)
+	if err != nil {
+		return err
+	} else if len(excludes) == 0 {
+		return nil
+	}
+
+	for _, src := range sources {
+		var patterns []string
+		if v, ok := src.Attrs[pb.AttrExcludePatterns]; ok {
+			if err := json.Unmarshal([]byte(v), &patterns); err != nil {
+				return fmt.Errorf("invalid exclude patterns for %s: %w", src.Identifier, err)
+			}
+		}
+		patterns = append(patterns, excludes...)
+
+		data, err := json.Marshal(patterns)
+		if err != nil {
+			return err
+		}
+
+		if src.Attrs == nil {
+			src.Attrs = make(map[string]string)
+		}
+		src.Attrs[pb.AttrExcludePatterns] = string(data)
+	}
+	return nil
+}
+
+// readDockerignore reads the exclude patterns for the build context.
+// A dockerignore file next to dockerfile.nix takes precedence over
+// the dockerignore file in the build context.
+func readDockerignore(ctx context.Context, c client.Client) ([]string, error) {
+	for _, f := range []struct {
+		local    string
+		filename string
+	}{
+		{local: "dockerfile", filename: "dockerfile.nix.dockerignore"},
+		{local: "context", filename: ".dockerignore"},
+	} {
+		dt, err := readLocalFile(ctx, c, f.local, f.filename)
+		if err != nil {
+			return nil, err
+		} else if dt == nil {
+			continue
+		}
+
+		excludes, err := ignorefile.ReadAll(bytes.NewReader(dt))
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %s: %w", f.filename, err)
+		}
+		return excludes, nil
+	}
+	return nil, nil
+}
+
+// readLocalFile reads a single file from a local source.
+// A missing file is not an error and returns nil.
+func readLocalFile(ctx context.Context, c client.Client, name, filename string) ([]byte, error) {
+	st := llb.Local(name,
+		llb.FollowPaths([]string{filename}),
+		llb.SharedKeyHint(name+"-"+filename),
+		llb.Differ(llb.DiffNone, false),
+		llb.WithCustomNamef("[dockerfile] load %s", filename),
+	)
+
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Solve(ctx, client.SolveRequest{
+		Definition: def.ToPB(),
+		Evaluate:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors from reading the file do not say whether the file is
+	// missing once they pass through the gateway, so the directory
+	// is listed first and every error from reading it is returned.
+	entries, err := ref.ReadDir(ctx, client.ReadDirRequest{
+		Path:           path.Dir(filename),
+		IncludePattern: path.Base(filename),
+	})
+	if err != nil {
+		return nil, err
+	} else if len(entries) == 0 {
+		// The file does not exist.
+		return nil, nil
+	}
+
+	return ref.ReadFile(ctx, client.ReadRequest{
+		Filename: filename,
+	})
+}
+
+// resolveOCILayouts binds each oci-layout source to the named build context
+// with the same name. The build context provides the store in the client
+// session and the digest of the image.
+func resolveOCILayouts(c client.Client, gr *graph) error {
+	opts := c.BuildOpts()
+	return gr.Walk(func(op *pb.Op) error {
+		src := op.GetSource()
+		if src == nil {
+			return nil
+		}
+
+		refName, ok := strings.CutPrefix(src.Identifier, "oci-layout://")
+		if !ok || src.Attrs[pb.AttrOCILayoutStoreID] != "" {
+			return nil
+		}
+
+		name, pin, _ := strings.Cut(refName, "@")
+		v, ok := opts.Opts["context:"+name]
+		if !ok {
+			return fmt.Errorf("oci layout %q requires a build context: use --build-context %s=oci-layout://<path>", name, name)
+		}
+
+		refSpec, ok := strings.CutPrefix(v, "oci-layout://")
+		if !ok {
+			return fmt.Errorf("build context %q is not an oci layout: %s", name, v)
+		}
+
+		ref, err := reference.Parse(refSpec)
+		if err != nil {
+			return fmt.Errorf("could not parse oci-layout reference %q: %w", refSpec, err)
+		}
+
+		named, ok := ref.(reference.Named)
+		if !ok {
+			return fmt.Errorf("oci-layout reference %q has no name", refSpec)
+		}
+
+		digested, ok := named.(reference.Digested)
+		if !ok {
+			return fmt.Errorf("oci-layout reference %q has no digest", refSpec)
+		}
+
+		if pin != "" && pin != digested.Digest().String() {
+			return fmt.Errorf("build context %q has digest %s but %s was requested", name, digested.Digest(), pin)
+		}
+
+		// The store id is not significant for the name of the image
+		// so use the name of the build context for the identifier.
+		id, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return fmt.Errorf("could not parse oci-layout reference %q: %w", name, err)
+		}
+
+		id, err = reference.WithDigest(id, digested.Digest())
+		if err != nil {
+			return err
+		}
+
+		src.Identifier = "oci-layout://" + id.String()
+		if src.Attrs == nil {
+			src.Attrs = make(map[string]string)
+		}
+		src.Attrs[pb.AttrOCILayoutSessionID] = opts.SessionID
+		src.Attrs[pb.AttrOCILayoutStoreID] = named.Name()
+		return nil
+	})
+}
+
 func resolveImageConfigs(ctx context.Context, c client.Client, gr *graph) (map[string]*Image, error) {
 	m := sync.Map{}
 	seen := make(map[string]struct{})
@@ -218,43 +548,77 @@ func resolveImageConfigs(ctx context.Context, c client.Client, gr *graph) (map[s
 	eg, ctx := errgroup.WithContext(ctx)
 	defer eg.Wait()
 
-	if err := gr.Walk(func(op *pb.Op) error {
-		switch op := op.Op.(type) {
-		case *pb.Op_Source:
-			if !strings.HasPrefix(op.Source.Identifier, "docker-image://") {
-				return nil
-			}
+	resolve := func(key, refName string, opt sourceresolver.Opt) error {
+		ref, dgst, dt, err := c.ResolveImageConfig(ctx, refName, opt)
+		if err != nil {
+			return err
+		}
 
-			refName := strings.TrimPrefix(op.Source.Identifier, "docker-image://")
-			named, err := reference.ParseNormalizedNamed(refName)
-			if err != nil {
-				return err
-			}
-			refName = reference.TagNameOnly(named).String()
-			op.Source.Identifier = "docker-image://" + refName
-			if _, ok := seen[refName]; ok {
-				return nil
-			}
-			seen[refName] = struct{}{}
+		var img dockerspec.DockerOCIImage
+		if err := json.Unmarshal(dt, &img); err != nil {
+			return err
+		}
 
-			eg.Go(func() error {
-				ref, dgst, dt, err := c.ResolveImageConfig(ctx, refName, sourceresolver.Opt{})
+		m.Store(key, &Image{
+			Ref:            ref,
+			Digest:         dgst,
+			DockerOCIImage: img,
+		})
+		return nil
+	}
+
+	if err := gr.Walk(func(pbOp *pb.Op) error {
+		var platform *ocispecs.Platform
+		if pbOp.Platform != nil {
+			p := pbOp.Platform.Spec()
+			platform = &p
+		}
+
+		switch op := pbOp.Op.(type) {
+		case *pb.Op_Source:
+			switch scheme, refName, _ := strings.Cut(op.Source.Identifier, "://"); scheme {
+			case "docker-image":
+				named, err := reference.ParseNormalizedNamed(refName)
 				if err != nil {
 					return err
 				}
+				refName = reference.TagNameOnly(named).String()
+				op.Source.Identifier = "docker-image://" + refName
 
-				var img dockerspec.DockerOCIImage
-				if err := json.Unmarshal(dt, &img); err != nil {
-					return err
+				key := imageKey(refName, pbOp.Platform)
+				if _, ok := seen[key]; ok {
+					return nil
 				}
+				seen[key] = struct{}{}
 
-				m.Store(refName, &Image{
-					Ref:            ref,
-					Digest:         dgst,
-					DockerOCIImage: img,
+				opt := sourceresolver.Opt{
+					Platform: platform,
+				}
+				eg.Go(func() error {
+					return resolve(key, refName, opt)
+				})
+			case "oci-layout":
+				// Key by the full identifier so these are not confused
+				// with registry images of the same name.
+				key := imageKey(op.Source.Identifier, pbOp.Platform)
+				if _, ok := seen[key]; ok {
+					return nil
+				}
+				seen[key] = struct{}{}
+
+				opt := sourceresolver.Opt{
+					Platform: platform,
+					OCILayoutOpt: &sourceresolver.ResolveOCILayoutOpt{
+						Store: sourceresolver.ResolveImageConfigOptStore{
+							SessionID: op.Source.Attrs[pb.AttrOCILayoutSessionID],
+							StoreID:   op.Source.Attrs[pb.AttrOCILayoutStoreID],
+						},
+					},
+				}
+				eg.Go(func() error {
+					return resolve(key, refName, opt)
 				})
-				return nil
-			})
+			}
 		}
 		return nil
 	}); err != nil {
@@ -272,10 +636,19 @@ func resolveImageConfigs(ctx context.Context, c client.Client, gr *graph) (map[s
 	return out, nil
 }
 
+// imageKey returns the key of a resolved image config. The platform is
+// part of the key since each platform of an image has its own config.
+func imageKey(ref string, platform *pb.Platform) string {
+	if platform == nil {
+		return ref
+	}
+	return ref + "@" + platforms.Format(platform.Spec())
+}
+
 func resolveInputs(ctx context.Context, c client.Client, frontendImg llb.State) (map[string]llb.State, error) {
 	runArgs := []string{
 		"nix-resolve-inputs",
-		"-f", "/src/dockerfile.nix",
+		"-f", nixFile,
 		"-o", "/result/inputs.json",
 	}
 
@@ -321,9 +694,9 @@ func resolveInputs(ctx context.Context, c client.Client, frontendImg llb.State)
 
 	inputMap := make(map[string]llb.State, len(rawInputs))
 	for k, b := range rawInputs {
-		def := &pb.Definition{}
-		if err := protojson.Unmarshal(b, def); err != nil {
-			return nil, err
+		def, err := readDefinition(b)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %w", k, err)
 		}
 
 		op, err := llb.NewDefinitionOp(def)
@@ -339,16 +712,114 @@ func getBuildArgs(c client.Client) map[string]string {
 	args := make(map[string]string)
 	for k, v := range c.BuildOpts().Opts {
 		k, found := strings.CutPrefix(k, "build-arg:")
-		if !found {
+		if !found || isProxyArg(k) {
 			continue
 		}
 
-		k = toLowerCamelCase(k)
-		args[k] = v
+		args[buildArgName(k)] = v
 	}
 	return args
 }
 
+// platformArgNames are the names of the standard platform args. The
+// build args use the names from the Dockerfile frontend which do not
+// separate the words so they cannot be converted to lower camel case.
+var platformArgNames = map[string]string{
+	"BUILDPLATFORM":  "buildPlatform",
+	"BUILDOS":        "buildOS",
+	"BUILDARCH":      "buildArch",
+	"BUILDVARIANT":   "buildVariant",
+	"TARGETPLATFORM": "targetPlatform",
+	"TARGETOS":       "targetOS",
+	"TARGETARCH":     "targetArch",
+	"TARGETVARIANT":  "targetVariant",
+}
+
+// buildArgName returns the name of the argument passed to nix for
+// the build arg.
+func buildArgName(k string) string {
+	if name, ok := platformArgNames[k]; ok {
+		return name
+	}
+	return toLowerCamelCase(k)
+}
+
+// getPlatformArgs returns the standard platform args for the build and
+// target platforms. The build platform is the default platform of the
+// first worker and the target platform is the requested platform.
+func getPlatformArgs(c client.Client) (map[string]string, error) {
+	opts := c.BuildOpts()
+
+	buildPlatform := platforms.DefaultSpec()
+	if len(opts.Workers) > 0 && len(opts.Workers[0].Platforms) > 0 {
+		buildPlatform = opts.Workers[0].Platforms[0]
+	}
+
+	targetPlatform := buildPlatform
+	if v := opts.Opts["platform"]; v != "" {
+		if strings.Contains(v, ",") {
+			return nil, fmt.Errorf("multiple platforms are not supported: %s", v)
+		}
+
+		p, err := platforms.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %w", v, err)
+		}
+		targetPlatform = platforms.Normalize(p)
+	}
+
+	args := make(map[string]string)
+	for prefix, p := range map[string]ocispecs.Platform{
+		"BUILD":  buildPlatform,
+		"TARGET": targetPlatform,
+	} {
+		args[buildArgName(prefix+"PLATFORM")] = platforms.Format(p)
+		args[buildArgName(prefix+"OS")] = p.OS
+		args[buildArgName(prefix+"ARCH")] = p.Architecture
+		args[buildArgName(prefix+"VARIANT")] = p.Variant
+	}
+	return args, nil
+}
+
+// getProxyEnv returns the proxy settings from the build args.
+// These are passed to exec ops without affecting the cache key
+// the same way the Dockerfile frontend does.
+func getProxyEnv(c client.Client) *pb.ProxyEnv {
+	pe := &pb.ProxyEnv{}
+	for k, v := range c.BuildOpts().Opts {
+		k, found := strings.CutPrefix(k, "build-arg:")
+		if !found {
+			continue
+		}
+
+		switch strings.ToLower(k) {
+		case "http_proxy":
+			pe.HttpProxy = v
+		case "https_proxy":
+			pe.HttpsProxy = v
+		case "ftp_proxy":
+			pe.FtpProxy = v
+		case "no_proxy":
+			pe.NoProxy = v
+		case "all_proxy":
+			pe.AllProxy = v
+		}
+	}
+
+	if pe.EqualVT(&pb.ProxyEnv{}) {
+		return nil
+	}
+	return pe
+}
+
+func isProxyArg(k string) bool {
+	switch strings.ToLower(k) {
+	case "http_proxy", "https_proxy", "ftp_proxy", "no_proxy", "all_proxy":
+		return true
+	}
+	return false
+}
+
 var lowerCamelCase = sync.OnceValue(func() *regexp.Regexp {
 	return regexp.MustCompile(`_(.)`)
 })
@@ -0,0 +1,29 @@
+package dockerfile
+
+import "testing"
+
+func TestReadDefinition(t *testing.T) {
+	if _, err := readDefinition([]byte(`{"version":1,"def":[]}`)); err != nil {
+		t.Fatalf("expected the versioned definition to be read, got %v", err)
+	}
+
+	if _, err := readDefinition([]byte(`{"version":1,"unknown":true}`)); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func TestBuildArgName(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{in: "MY_BUILD_ARG", want: "myBuildArg"},
+		{in: "TARGETPLATFORM", want: "targetPlatform"},
+		{in: "BUILDOS", want: "buildOS"},
+		{in: "TARGET_PLATFORM", want: "targetPlatform"},
+	} {
+		if got := buildArgName(tt.in); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.want, got)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package dockerfile
 
 import (
+	"encoding/json"
+	"fmt"
 	"iter"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/moby/buildkit/solver/pb"
 	"github.com/opencontainers/go-digest"
@@ -11,6 +16,9 @@ type graph struct {
 	opByDigest  map[string]*pb.Op
 	digestOrder []string
 	metadata    map[string]*pb.OpMetadata
+	outputs     map[string]string
+	checks      map[string]string
+	source      *pb.Source
 }
 
 func newGraph(def *pb.Definition) (*graph, error) {
@@ -28,18 +36,121 @@ func newGraph(def *pb.Definition) (*graph, error) {
 		}
 		opByDigest[dgst] = op
 	}
+
+	var (
+		outputs = make(map[string]string)
+		checks  = make(map[string]string)
+	)
+	for _, dgst := range digestOrder {
+		meta := def.Metadata[dgst]
+		if meta == nil || meta.Description[OutputsKey] == "" {
+			continue
+		}
+
+		var names map[string]string
+		if err := json.Unmarshal([]byte(meta.Description[OutputsKey]), &names); err != nil {
+			return nil, fmt.Errorf("invalid outputs for %s: %w", dgst, err)
+		}
+		for name, check := range names {
+			outputs[name] = dgst
+			if check != "" {
+				checks[name] = check
+			}
+		}
+	}
+
+	if len(outputs) == 0 && len(digestOrder) > 0 {
+		// Definitions without named outputs only have the default.
+		outputs["default"] = digestOrder[len(digestOrder)-1]
+	}
+
 	return &graph{
 		opByDigest:  opByDigest,
 		digestOrder: digestOrder,
 		metadata:    def.Metadata,
+		outputs:     outputs,
+		checks:      checks,
+		source:      def.Source,
 	}, nil
 }
 
+// Outputs returns the sorted names of the outputs in the graph.
+func (g *graph) Outputs() []string {
+	return slices.Sorted(maps.Keys(g.outputs))
+}
+
+// Select makes the named output the head of the graph. Vertices
+// that are not used by the output are removed from the graph.
+func (g *graph) Select(name string) error {
+	head, ok := g.outputs[name]
+	if !ok {
+		return fmt.Errorf("output %q not found, available outputs: %s",
+			name, strings.Join(g.Outputs(), ", "))
+	}
+
+	reachable := make(map[string]struct{})
+
+	var visit func(dgst string) error
+	visit = func(dgst string) error {
+		if _, ok := reachable[dgst]; ok {
+			return nil
+		}
+		reachable[dgst] = struct{}{}
+
+		op, ok := g.opByDigest[dgst]
+		if !ok {
+			return fmt.Errorf("output %q refers to %s which is not in the definition", name, dgst)
+		}
+
+		for _, inp := range op.Inputs {
+			if err := visit(inp.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(head); err != nil {
+		return err
+	}
+
+	g.digestOrder = slices.DeleteFunc(g.digestOrder, func(dgst string) bool {
+		if _, ok := reachable[dgst]; !ok {
+			delete(g.opByDigest, dgst)
+			return true
+		}
+		return false
+	})
+	g.outputs = map[string]string{name: head}
+	g.checks = map[string]string{name: g.checks[name]}
+	return nil
+}
+
 func (g *graph) Head() (digest.Digest, *pb.Op) {
 	dgst := g.digestOrder[len(g.digestOrder)-1]
 	return digest.Digest(dgst), g.opByDigest[dgst]
 }
 
+// Check returns the name of the check when the selected output
+// is a check target.
+func (g *graph) Check() string {
+	for _, check := range g.checks {
+		if check != "" {
+			return check
+		}
+	}
+
+	head, _ := g.Head()
+	if meta := g.metadata[string(head)]; meta != nil {
+		return meta.Description[CheckKey]
+	}
+	return ""
+}
+
+// SourceInfos returns the files referenced by the source map.
+func (g *graph) SourceInfos() []*pb.SourceInfo {
+	return g.source.GetInfos()
+}
+
 func (g *graph) All() iter.Seq2[digest.Digest, *pb.Op] {
 	return func(yield func(digest.Digest, *pb.Op) bool) {
 		for _, dgst := range g.digestOrder {
@@ -64,6 +175,13 @@ func (g *graph) ToDef() (*pb.Definition, error) {
 	def := &pb.Definition{
 		Metadata: make(map[string]*pb.OpMetadata),
 	}
+	if g.source != nil {
+		def.Source = &pb.Source{
+			Locations: make(map[string]*pb.Locations),
+			Infos:     g.source.Infos,
+		}
+	}
+
 	newDigests := make(map[string]string)
 	for _, dgst := range g.digestOrder {
 		op := g.opByDigest[dgst]
@@ -86,6 +204,9 @@ func (g *graph) ToDef() (*pb.Definition, error) {
 		if meta := g.metadata[dgst]; meta != nil {
 			def.Metadata[newDgst] = meta
 		}
+		if locs := g.source.GetLocations()[dgst]; locs != nil {
+			def.Source.Locations[newDgst] = locs
+		}
 	}
 	return def, nil
 }
@@ -0,0 +1,82 @@
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestSelectCheckPerOutput(t *testing.T) {
+	src, err := (&pb.Op{
+		Op: &pb.Op_Source{
+			Source: &pb.SourceOp{Identifier: "docker-image://docker.io/library/alpine:latest"},
+		},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := (&pb.Op{
+		Inputs: []*pb.Input{
+			{Digest: string(digest.FromBytes(src))},
+		},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		output string
+		check  string
+	}{
+		{output: "default", check: ""},
+		{output: "test", check: "test"},
+	} {
+		t.Run(tt.output, func(t *testing.T) {
+			def := &pb.Definition{
+				Def: [][]byte{src, result},
+				Metadata: map[string]*pb.OpMetadata{
+					string(digest.FromBytes(result)): {
+						Description: map[string]string{
+							OutputsKey: `{"default":"","test":"test"}`,
+						},
+					},
+				},
+			}
+
+			gr, err := newGraph(def)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := gr.Select(tt.output); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := gr.Check(); got != tt.check {
+				t.Errorf("expected check %q, got %q", tt.check, got)
+			}
+		})
+	}
+}
+
+func TestSelectMissingInput(t *testing.T) {
+	result, err := (&pb.Op{
+		Inputs: []*pb.Input{
+			{Digest: string(digest.FromString("missing"))},
+		},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gr, err := newGraph(&pb.Definition{Def: [][]byte{result}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gr.Select("default"); err == nil {
+		t.Fatal("expected an error for the missing input")
+	}
+}
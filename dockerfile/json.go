@@ -1,28 +1,109 @@
 package dockerfile
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
 )
 
+// SpecVersion is the version of the op spec format and of the definition
+// written by marshal. It is increased whenever the format changes in a way
+// that an older frontend cannot read. The nix library writes the same version.
+const SpecVersion = 1
+
 type OpSpec struct {
-	Source *SourceOp `json:"source,omitempty"`
-	Exec   *ExecOp   `json:"exec,omitempty"`
-	File   *FileOp   `json:"file,omitempty"`
-	Merge  *MergeOp  `json:"merge,omitempty"`
-	Meta   *Metadata `json:"meta,omitempty"`
+	Version int       `json:"version,omitempty"`
+	Source  *SourceOp `json:"source,omitempty"`
+	Exec    *ExecOp   `json:"exec,omitempty"`
+	File    *FileOp   `json:"file,omitempty"`
+	Merge   *MergeOp  `json:"merge,omitempty"`
+	Diff    *DiffOp   `json:"diff,omitempty"`
+	Meta    *Metadata `json:"meta,omitempty"`
 }
 
 type SourceOp struct {
-	Identifier string            `json:"identifier"`
-	Attributes map[string]string `json:"attrs,omitempty"`
+	Identifier      string            `json:"identifier,omitempty"`
+	Attributes      map[string]string `json:"attrs,omitempty"`
+	IncludePatterns []string          `json:"includePatterns,omitempty"`
+	ExcludePatterns []string          `json:"excludePatterns,omitempty"`
+	SharedKey       string            `json:"sharedKey,omitempty"`
+	Git             *GitSource        `json:"git,omitempty"`
+	HTTP            *HTTPSource       `json:"http,omitempty"`
+	OCILayout       *OCILayoutSource  `json:"ociLayout,omitempty"`
+	Platform        string            `json:"platform,omitempty"`
+	Constraints     []string          `json:"constraints,omitempty"`
+}
+
+type GitSource struct {
+	Remote           string `json:"remote"`
+	Ref              string `json:"ref,omitempty"`
+	Commit           string `json:"commit,omitempty"`
+	Subdir           string `json:"subdir,omitempty"`
+	KeepGitDir       bool   `json:"keepGitDir,omitempty"`
+	SkipSubmodules   bool   `json:"skipSubmodules,omitempty"`
+	AuthTokenSecret  string `json:"authTokenSecret,omitempty"`
+	AuthHeaderSecret string `json:"authHeaderSecret,omitempty"`
 }
 
 type ExecOp struct {
-	Command []string              `json:"command"`
-	Mounts  map[string]*MountSpec `json:"mounts"`
-	Workdir string                `json:"workdir"`
-	Env     []string              `json:"env"`
+	Command        []string               `json:"command"`
+	Mounts         map[string]*MountSpec  `json:"mounts"`
+	Workdir        string                 `json:"workdir"`
+	Env            []string               `json:"env"`
+	User           string                 `json:"user,omitempty"`
+	Hostname       string                 `json:"hostname,omitempty"`
+	ExtraHosts     map[string]string      `json:"extraHosts,omitempty"`
+	Ulimits        map[string]*UlimitSpec `json:"ulimits,omitempty"`
+	CgroupParent   string                 `json:"cgroupParent,omitempty"`
+	ValidExitCodes []int32                `json:"validExitCodes,omitempty"`
+	Script         *ScriptSpec            `json:"script,omitempty"`
+	Platform       string                 `json:"platform,omitempty"`
+	Constraints    []string               `json:"constraints,omitempty"`
+}
+
+type ScriptSpec struct {
+	Text        string   `json:"text"`
+	Interpreter []string `json:"interpreter,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	Mode        string   `json:"mode,omitempty"`
+	Inline      bool     `json:"inline,omitempty"`
+}
+
+type UlimitSpec struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+type HTTPSource struct {
+	URL              string            `json:"url"`
+	Checksum         string            `json:"checksum,omitempty"`
+	Filename         string            `json:"filename,omitempty"`
+	Perm             string            `json:"perm,omitempty"`
+	UID              int               `json:"uid,omitempty"`
+	GID              int               `json:"gid,omitempty"`
+	AuthHeaderSecret string            `json:"authHeaderSecret,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+}
+
+// UnmarshalJSON rejects unknown fields so a misspelled
+// attribute is reported instead of silently ignored.
+func (s *HTTPSource) UnmarshalJSON(p []byte) error {
+	type httpSource HTTPSource
+
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*httpSource)(s)); err != nil {
+		return fmt.Errorf("http source: %w", err)
+	}
+	return nil
+}
+
+// OCILayoutSource is an image from an oci layout. The layout is provided
+// by the client as a named build context.
+type OCILayoutSource struct {
+	Context string `json:"context"`
+	Digest  string `json:"digest,omitempty"`
 }
 
 type MountSpec struct {
@@ -37,18 +118,108 @@ type FileOp struct {
 }
 
 type FSEntry struct {
-	Source string `json:"source,omitempty"`
-	Text   string `json:"text,omitempty"`
-	Mode   string `json:"mode,omitempty"`
+	Source    string `json:"source,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Checksum  string `json:"checksum,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Directory bool   `json:"directory,omitempty"`
+	Remove    bool   `json:"remove,omitempty"`
+	Symlink   string `json:"symlink,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	Chown     string `json:"chown,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	CopyOptions
+}
+
+// CopyOptions control how a source is copied into the destination.
+type CopyOptions struct {
+	Include                        []string `json:"include,omitempty"`
+	Exclude                        []string `json:"exclude,omitempty"`
+	FollowSymlinks                 bool     `json:"followSymlinks,omitempty"`
+	AllowWildcard                  bool     `json:"allowWildcard,omitempty"`
+	CreateDestPath                 bool     `json:"createDestPath,omitempty"`
+	CopyDirContentsOnly            bool     `json:"copyDirContentsOnly,omitempty"`
+	AlwaysReplaceExistingDestPaths bool     `json:"alwaysReplaceExistingDestPaths,omitempty"`
+	Unpack                         bool     `json:"unpack,omitempty"`
+}
+
+// IsZero reports whether the default copy options are used.
+func (o *CopyOptions) IsZero() bool {
+	return len(o.Include) == 0 && len(o.Exclude) == 0 &&
+		!o.FollowSymlinks && !o.AllowWildcard && !o.CreateDestPath &&
+		!o.CopyDirContentsOnly && !o.AlwaysReplaceExistingDestPaths &&
+		!o.Unpack
 }
 
 type MergeOp struct {
-	Target string   `json:"target,omitempty"`
-	Inputs []string `json:"inputs,omitempty"`
+	Target string         `json:"target,omitempty"`
+	Inputs []*MergeSource `json:"inputs,omitempty"`
+}
+
+// MergeSource is an input to a merge. It is either the path
+// of the input or an object with the path and copy options.
+type MergeSource struct {
+	Source string `json:"source"`
+	CopyOptions
+}
+
+func (m *MergeSource) UnmarshalJSON(p []byte) error {
+	if err := json.Unmarshal(p, &m.Source); err == nil {
+		return nil
+	}
+
+	type mergeSource MergeSource
+	return json.Unmarshal(p, (*mergeSource)(m))
+}
+
+// CheckKey is the prefix of the result metadata for a check target.
+// Definitions written before outputs could be named use it as the
+// description key of the result vertex with the name of the check.
+const CheckKey = "nix.check"
+
+// OutputsKey is the description key used to name the result vertices
+// of a definition. The value is a JSON object that maps the names of
+// the outputs that refer to the vertex to the name of their check.
+// The check is empty when the output is not a check.
+//
+// Checks are recorded per output since outputs that refer to the same
+// vertex share a single result vertex.
+const OutputsKey = "nix.outputs"
+
+type DiffOp struct {
+	Lower string `json:"lower,omitempty"`
+	Upper string `json:"upper,omitempty"`
 }
 
 type Metadata struct {
-	Description map[string]string `json:"description,omitempty"`
+	Description   map[string]string `json:"description,omitempty"`
+	Locations     []*Location       `json:"locations,omitempty"`
+	ProgressGroup *ProgressGroup    `json:"progressGroup,omitempty"`
+}
+
+// ProgressGroup collects the ops created by a library or target into
+// a single section of the progress output.
+type ProgressGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Weak bool   `json:"weak,omitempty"`
+}
+
+// DefaultNameKey is the description key for the name generated for an
+// op. It is used as the custom name when one has not been given.
+const DefaultNameKey = "nix.defaultname"
+
+// MergeName returns the default name of a merge with the given number
+// of inputs.
+func MergeName(inputs int) string {
+	return fmt.Sprintf("merge (%d inputs)", inputs)
+}
+
+// Location is the position in a nix file that defined an op.
+type Location struct {
+	File   string `json:"file"`
+	Line   int32  `json:"line"`
+	Column int32  `json:"column,omitempty"`
 }
 
 func ReadOpSpec(fpath string) (*OpSpec, error) {
@@ -57,9 +228,35 @@ func ReadOpSpec(fpath string) (*OpSpec, error) {
 		return nil, err
 	}
 
+	// Check the version before decoding the spec so a newer format
+	// is reported as such instead of as a decoding error.
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(in, &header); err != nil {
+		return nil, err
+	}
+
+	if err := checkSpecVersion(header.Version); err != nil {
+		return nil, err
+	}
+
 	var spec OpSpec
 	if err := json.Unmarshal(in, &spec); err != nil {
 		return nil, err
 	}
 	return &spec, nil
 }
+
+// checkSpecVersion returns an error when the version is newer than
+// SpecVersion. Libraries declare the version they require so they are
+// rejected here instead of being misread by an older frontend.
+func checkSpecVersion(version int) error {
+	switch {
+	case version < 0:
+		return fmt.Errorf("invalid spec version %d", version)
+	case version > SpecVersion:
+		return fmt.Errorf("library requires frontend with spec version >= %d, this frontend supports spec version %d: update the frontend", version, SpecVersion)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package dockerfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadOpSpecVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		spec    string
+		version int
+		err     string
+	}{
+		{name: "unversioned", spec: `{"merge":{}}`, version: 0},
+		{name: "current", spec: `{"version":1,"merge":{}}`, version: 1},
+		{name: "required", spec: `{"version":2,"merge":{}}`, err: "library requires frontend with spec version >= 2"},
+		{name: "invalid", spec: `{"version":-1,"merge":{}}`, err: "invalid spec version -1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(t.TempDir(), "spec.json")
+			if err := os.WriteFile(fpath, []byte(tt.spec), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			spec, err := ReadOpSpec(fpath)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if spec.Version != tt.version {
+				t.Fatalf("expected version %d, got %d", tt.version, spec.Version)
+			}
+		})
+	}
+}
@@ -11,7 +11,7 @@ let
   };
 
   args = if argsfile != null
-    then builtins.fromJSON argsfile
+    then builtins.fromJSON (builtins.readFile argsfile)
     else {};
 
   allArgs = args // {
@@ -34,21 +34,40 @@ let
   in
     lib.llb.inputs mapped;
 
+  # Ops created by a library or a target are collected in a progress
+  # group with its name.
+  groupedArgs = id: name: allArgs // {
+    lib = lib // {
+      llb = lib.llb.group { inherit id name; };
+    };
+  };
+
   targets = let
     f = config.targets;
     inputNames = builtins.attrNames inputs;
     importByName = name: {
       inherit name;
-      value = import (builtins.findFile builtins.nixPath name) allArgs;
+      value = import (builtins.findFile builtins.nixPath name) (groupedArgs "library:${name}" name);
     };
-    defaultImports.std = import <std> allArgs;
+    defaultImports.std = import <std> (groupedArgs "library:std" "std");
     userImports = builtins.listToAttrs (builtins.map importByName inputNames);
     withImports = allArgs
       // defaultImports
       // userImports;
-    targets = f withImports;
+
+    # Each target is evaluated with its own library so the ops defined
+    # by the target itself are grouped under the target name.
+    # Ops in a target that have no position of their own are located
+    # at the definition of the target.
+    targetFor = name: let
+      grouped = (groupedArgs "target:${name}" name).lib;
+      pos = builtins.unsafeGetAttrPos name (f withImports);
+      targets = f (withImports // {
+        lib = grouped // { llb = grouped.llb.locatedAt pos; };
+      });
+    in targets.${name};
   in
-    builtins.mapAttrs (name: lib.llb.marshal) targets;
+    builtins.mapAttrs (name: _: lib.llb.marshal (targetFor name)) (f withImports);
 
   finalConfig = config // {
     inherit targets;
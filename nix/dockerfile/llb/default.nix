@@ -1,4 +1,9 @@
-{ system ? builtins.currentSystem }:
+{
+  system ? builtins.currentSystem,
+  progressGroup ? null,
+  defaultPos ? null,
+  requiredVersion ? null,
+}@libArgs:
 
 let
   mkOp = name: spec: derivation {
@@ -8,40 +13,185 @@ let
     args = [ "$specPath" "$out" ];
 
     passAsFile = ["spec"];
-    spec = builtins.toJSON spec;
+    spec = builtins.toJSON (withProgressGroup spec // { version = specVersion'; });
   };
 
+  # The version of the op spec format. Frontends that only support an
+  # older version refuse to read the spec.
+  specVersion = 1;
+
+  # The version written to the spec. A library that depends on a newer
+  # format than this library writes declares it with requireVersion so
+  # an older frontend reports it instead of misreading the spec.
+  specVersion' = if requiredVersion != null && requiredVersion > specVersion
+    then requiredVersion
+    else specVersion;
+
+  # Imports this library again with some of its arguments changed.
+  reimport = changed: import ./. (libArgs // changed);
+
+  # Adds the progress group of the library to the spec unless the op
+  # has already been given one.
+  withProgressGroup = spec:
+    if progressGroup == null || (spec.meta or {}) ? progressGroup
+      then spec
+      else spec // {
+        meta = (spec.meta or {}) // { inherit progressGroup; };
+      };
+
+  toUlimit = name: v: if builtins.isInt v
+    then { soft = v; hard = v; }
+    else v;
+
+  toScript = v: if v == null
+    then null
+    else { interpreter = [ "/bin/sh" ]; } // (if builtins.isString v then { text = v; } else v);
+
+  toFSEntry = v: v // (if v ? timestamp
+    then { timestamp = toString v.timestamp; }
+    else {});
+
+  # Options for local sources that are passed as typed fields
+  # instead of source attributes.
+  localOptions = {
+    includePatterns = null;
+    excludePatterns = null;
+    sharedKey = null;
+  };
+
+  # Converts a string into a valid derivation name. Sources are named
+  # after what they refer to so the name can be shown in the progress.
+  toDrvName = v: builtins.concatStringsSep ""
+    (map (x: if builtins.isList x then "-" else x)
+      (builtins.split "[^A-Za-z0-9+._?=-]+" v));
+
   toAttrStr = v: if builtins.isString v
     then v
     else builtins.toJSON v;
+
+  # Returns the position of an attrset that was passed to a library
+  # function. Attributes defined in this file are ignored so the
+  # position points at the caller.
+  posOf = v: let
+    positions = builtins.filter (p: p != null && p.file != __curPos.file)
+      (map (name: builtins.unsafeGetAttrPos name v) (builtins.attrNames v));
+    earliest = a: b: if b.line < a.line then b else a;
+  in if builtins.isAttrs v && positions != []
+    then builtins.foldl' earliest (builtins.head positions) positions
+    else null;
+
+  # Records the position of the attrset in the metadata of the spec
+  # so it can be shown when the op fails. Ops that are created without
+  # an attrset, such as run "cmd" or merge, have no position of their
+  # own and use the default position of the library instead. Inside a
+  # target this is the position of the target, outside of one they are
+  # not located.
+  withPos = v: spec: let
+    p = posOf v;
+    pos = if p != null then p else defaultPos;
+  in if pos == null
+    then spec
+    else spec // {
+      meta = (spec.meta or {}) // { locations = [ pos ]; };
+    };
 in
 rec {
-  local = name: attrs: mkOp "source" {
+  # Returns this library with every op it creates in the progress group.
+  # The group may be a name or an attrset with an id and a name.
+  group = g: reimport {
+    progressGroup = if builtins.isString g
+      then { id = g; name = g; }
+      else g;
+  };
+
+  # Returns this library with pos as the position of ops that are
+  # created without an attrset to locate.
+  locatedAt = pos: reimport { defaultPos = pos; };
+
+  # Returns this library with ops that require a frontend supporting
+  # at least the given version of the op spec format.
+  requireVersion = v: reimport { requiredVersion = v; };
+
+  local = name: attrs: mkOp "local-${toDrvName name}" (withPos attrs {
     source = {
       identifier = "local://${name}";
-      attrs = builtins.mapAttrs (k: toAttrStr) attrs;
+      attrs = builtins.mapAttrs (k: toAttrStr)
+        (removeAttrs attrs (builtins.attrNames localOptions));
+    } // builtins.intersectAttrs localOptions attrs;
+  });
+
+  image = nameOrOpts: let
+      make = {
+        name,
+        platform ? "",
+        constraints ? [],
+      }@opts: mkOp "image-${toDrvName name}" (withPos opts {
+        source = {
+          identifier = "docker-image://${name}";
+          inherit platform constraints;
+        };
+      });
+    in
+      if builtins.isString nameOrOpts
+        then make { name = nameOrOpts; }
+        else make nameOrOpts;
+
+  git = remote: {
+    ref ? "",
+    commit ? "",
+    subdir ? "",
+    keepGitDir ? false,
+    skipSubmodules ? false,
+    authTokenSecret ? "",
+    authHeaderSecret ? "",
+  }@opts: mkOp "git-${toDrvName (baseNameOf remote)}" (withPos opts {
+    source.git = {
+      inherit remote ref commit subdir keepGitDir skipSubmodules;
+      inherit authTokenSecret authHeaderSecret;
     };
-  };
+  });
 
-  image = name: mkOp "source" {
-    source.identifier = "docker-image://${name}";
-  };
+  http = url: opts: mkOp "http-${toDrvName (baseNameOf url)}" (withPos opts {
+    source.http = { inherit url; } // opts;
+  });
 
-  merge = target: inputs: mkOp "merge" {
+  ociLayout = context: mkOp "oci-layout-${toDrvName (if builtins.isString context then context else context.context)}" (withPos context {
+    source.ociLayout = if builtins.isString context
+      then { inherit context; }
+      else context;
+  });
+
+  merge = target: inputs: mkOp "merge" (withPos null {
     merge = { inherit target inputs; };
-  };
+  });
 
-  file = target: locations: mkOp "file" {
-    file = { inherit target locations; };
-  };
+  diff = lower: upper: mkOp "diff" (withPos null {
+    diff = { inherit lower upper; };
+  });
+
+  file = target: locations: mkOp "file" (withPos locations {
+    file = {
+      inherit target;
+      locations = builtins.mapAttrs (path: toFSEntry) locations;
+    };
+  });
 
   run = optsOrCommand: let
       make = {
         mounts ? {},
         env ? {},
         workdir ? "/",
+        user ? "",
+        hostname ? "",
+        extraHosts ? {},
+        ulimits ? {},
+        cgroupParent ? "",
+        validExitCodes ? [],
+        script ? null,
+        platform ? "",
+        constraints ? [],
         meta ? {},
-      }: command: input: mkOp "exec" {
+      }@opts: command: input: mkOp "exec" (withPos opts {
         exec = {
           command = if builtins.isString command
             then [ "/bin/sh" "-c" command ]
@@ -51,14 +201,20 @@ rec {
           } // mounts;
           inherit workdir;
           env = builtins.attrValues (builtins.mapAttrs (name: value: "${name}=${value}") env);
+          ulimits = builtins.mapAttrs toUlimit ulimits;
+          script = toScript script;
+          inherit user hostname extraHosts cgroupParent validExitCodes;
+          inherit platform constraints;
         };
         inherit meta;
-      };
+      });
     in
       if (builtins.isList optsOrCommand || builtins.isString optsOrCommand)
         then make {} optsOrCommand
         else make optsOrCommand;
 
+  script = opts: text: run (opts // { script = text; }) [];
+
   inputs = spec: derivation {
     name = "llb-inputs.json";
     inherit system;
@@ -69,11 +225,34 @@ rec {
     passAsFile = ["spec"];
   };
 
-  marshal = input: derivation {
+  check = name: input: {
+    outPath = "${input}";
+    meta.check = name;
+  };
+
+  # Combines named outputs into a single target. The default output
+  # is built unless another output is selected with target/output.
+  outputs = heads: {
+    outPath = "${heads.default}";
+    meta.outputs = heads;
+  };
+
+  marshal = input: let
+    meta = if builtins.isAttrs input
+      then input.meta or {}
+      else {};
+    heads = meta.outputs or { default = input; };
+    headArgs = name: head: let
+      check = if builtins.isAttrs head
+        then head.meta.check or ""
+        else "";
+    in [ "--head" "${name}=${merge head []}" ]
+      ++ (if check != "" then [ "--check" "${name}=${check}" ] else []);
+  in derivation {
     name = "llb-def.json";
     inherit system;
-    input = merge input [];
     builder = "/bin/marshal";
-    args = [ "$input" "$out" ];
+    args = builtins.concatLists (builtins.attrValues (builtins.mapAttrs headArgs heads))
+      ++ [ "$out" ];
   };
 }
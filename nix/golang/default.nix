@@ -71,25 +71,20 @@ rec {
 
     testSupportBinaries = lib.llb.merge null [ "${gotestsum}/out" ];
 
-    vendorCommand = [ "/bin/sh" "/run/vendor" ];
-    doVendor = lib.llb.run {
+    doVendor = lib.llb.script {
       env.CGO_ENABLED = "0";
       workdir = "/app";
 
       mounts = defaultMounts // {
-        "/run".input = lib.llb.file null {
-          "/vendor".text = ''
-            #/bin/sh
-            set -eo pipefail
-            go mod tidy
-
-            go mod vendor -o /out/vendor
-            cp go.mod go.sum /out/
-          '';
-        };
         "/out" = {};
       };
-    } vendorCommand;
+    } ''
+      set -eo pipefail
+      go mod tidy
+
+      go mod vendor -o /out/vendor
+      cp go.mod go.sum /out/
+    '';
 
     vendorStage = doVendor image;
 
@@ -111,7 +106,7 @@ rec {
     };
     test = "${testStage}/out";
     vendor = "${vendorStage}/out";
-    validate-vendor = validateVendorStage;
+    validate-vendor = lib.llb.check "validate-vendor" validateVendorStage;
   in
   {
     inherit binaries test vendor validate-vendor;